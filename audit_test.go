@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"postSPA/db"
+	"postSPA/handlers"
+	"strings"
+	"testing"
+)
+
+// TestAuditChainCatchesEdits appends events through the API, checks
+// that the chain verifies, then edits a row around the triggers and
+// checks that verification reports it.
+func TestAuditChainCatchesEdits(t *testing.T) {
+	srv := newTestServer(t, nil)
+	author := srv.user("author", "user")
+	author.createPost("Audited")
+	if res := srv.anonymous().do("POST", "/api/v2/sessions", map[string]string{"username": "author", "password": "wrong-password"}); res.status != http.StatusUnauthorized {
+		t.Fatalf("login with a wrong password: got %d, want 401", res.status)
+	}
+
+	var events int
+	if err := db.Db.QueryRow("SELECT COUNT(*) FROM audit_events").Scan(&events); err != nil {
+		t.Fatal(err)
+	}
+	// Registration, login, post and failed login
+	if events != 4 {
+		t.Fatalf("got %d audit events, want 4", events)
+	}
+	v, err := handlers.VerifyAudit(db.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Problem != "" || v.Events != events {
+		t.Fatalf("intact chain verified as %+v, want %d events and no problem", v, events)
+	}
+
+	if _, err := db.Db.Exec("DROP TRIGGER audit_events_no_update"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec(`UPDATE audit_events SET details = '{"reason":"unknown_user"}' WHERE seq = 4`); err != nil {
+		t.Fatal(err)
+	}
+	v, err = handlers.VerifyAudit(db.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(v.Problem, "event 4 was modified") {
+		t.Errorf("edited chain verified with problem %q, want event 4 reported as modified", v.Problem)
+	}
+}
+
+// TestUnauditedActionFails makes audit appends fail and checks that
+// the action they describe is refused and rolled back with them.
+func TestUnauditedActionFails(t *testing.T) {
+	srv := newTestServer(t, nil)
+	author := srv.user("author", "user")
+	_, err := db.Db.Exec(`
+		CREATE TRIGGER audit_events_fail BEFORE INSERT ON audit_events
+		BEGIN
+			SELECT RAISE(ABORT, 'audit log unavailable');
+		END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := author.do("POST", "/api/v2/posts", map[string]string{"content": "Unrecorded"})
+	if res.status != http.StatusInternalServerError {
+		t.Errorf("creating a post without an audit event: got %d, want 500", res.status)
+	}
+	var posts int
+	if err := db.Db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&posts); err != nil {
+		t.Fatal(err)
+	}
+	if posts != 0 {
+		t.Errorf("%d posts were created without an audit event", posts)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"postSPA/config"
+	"postSPA/db"
+	"postSPA/handlers"
+	"postSPA/storage"
+)
+
+// newBlobStore builds the upload backend named by backend ("local" or
+// "s3") from the upload settings.
+func newBlobStore(ctx context.Context, cfg config.Uploads, backend string) (storage.BlobStore, error) {
+	switch backend {
+	case "local":
+		return storage.NewLocal(cfg.Dir, "/uploads")
+	case "s3":
+		return storage.NewS3(ctx, storage.S3Config{
+			Endpoint:  cfg.S3.Endpoint,
+			Bucket:    cfg.S3.Bucket,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+			Region:    cfg.S3.Region,
+			UseSSL:    cfg.S3.UseSSL,
+			PublicURL: cfg.S3.PublicURL,
+			ProxyURL:  "/uploads",
+		})
+	default:
+		return nil, fmt.Errorf("unknown upload backend %q", backend)
+	}
+}
+
+// migrateUploads implements `migrate-uploads -from local -to s3`.
+func migrateUploads(args []string) {
+	fs := flag.NewFlagSet("migrate-uploads", flag.ExitOnError)
+	from := fs.String("from", "local", "source backend (local or s3)")
+	to := fs.String("to", "s3", "destination backend (local or s3)")
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if *from == *to {
+		log.Fatalf("Source and destination are both %q", *from)
+	}
+
+	ctx := context.Background()
+	src, err := newBlobStore(ctx, cfg.Uploads, *from)
+	if err != nil {
+		log.Fatalf("Failed to open %s store: %v", *from, err)
+	}
+	dst, err := newBlobStore(ctx, cfg.Uploads, *to)
+	if err != nil {
+		log.Fatalf("Failed to open %s store: %v", *to, err)
+	}
+
+	copied, err := storage.Copy(ctx, src, dst)
+	if err != nil {
+		log.Fatalf("Migration stopped after %d files: %v", copied, err)
+	}
+	log.Printf("✅ Copied %d files from %s to %s", copied, *from, *to)
+}
+
+// gcUploads implements `gc-uploads [-dry-run]`. The grace period comes
+// from the upload-gc-grace setting.
+func gcUploads(args []string) {
+	fs := flag.NewFlagSet("gc-uploads", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be removed without deleting anything")
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if err := db.InitDB(cfg.Database); err != nil {
+		log.Fatalf("DB init failed: %v", err)
+	}
+	defer db.Db.Close()
+
+	ctx := context.Background()
+	store, err := newBlobStore(ctx, cfg.Uploads, cfg.Uploads.Backend)
+	if err != nil {
+		log.Fatalf("Failed to open upload storage: %v", err)
+	}
+
+	report, err := handlers.CollectUploads(ctx, db.Db, store, cfg.Uploads.GCGrace, *dryRun)
+	for _, key := range report.Removed {
+		fmt.Println(key)
+	}
+
+	verb := "Removed"
+	if report.DryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d of %d files (%d bytes), kept %d\n",
+		verb, len(report.Removed), report.Scanned, report.FreedBytes, report.Kept)
+
+	if err != nil {
+		log.Fatalf("Upload GC stopped early: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"postSPA/config"
+	"postSPA/db"
+	"postSPA/handlers"
+)
+
+// recount repairs the denormalized reaction and comment counters.
+func recount(args []string) {
+	fs := flag.NewFlagSet("recount", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report drifted counters without changing them")
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if err := db.InitDB(cfg.Database); err != nil {
+		log.Fatalf("DB init failed: %v", err)
+	}
+	defer db.Db.Close()
+
+	report, err := handlers.Recount(db.Db, *dryRun)
+	if err != nil {
+		log.Fatalf("Recount failed: %v", err)
+	}
+
+	for _, id := range report.Posts {
+		fmt.Println("post", id)
+	}
+	for _, id := range report.Comments {
+		fmt.Println("comment", id)
+	}
+
+	verb := "Repaired"
+	if report.DryRun {
+		verb = "Found"
+	}
+	fmt.Printf("%s wrong counts on %d posts and %d comments\n", verb, len(report.Posts), len(report.Comments))
+}
+
+// setRole makes a user a moderator or admin, or back into a plain user:
+// set-role [flags] <username> <user|moderator|admin>
+func setRole(args []string) {
+	fs := flag.NewFlagSet("set-role", flag.ExitOnError)
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if fs.NArg() != 2 {
+		log.Fatalf("Usage: set-role [flags] <username> <user|moderator|admin>")
+	}
+	username, role := fs.Arg(0), fs.Arg(1)
+
+	if err := db.InitDB(cfg.Database); err != nil {
+		log.Fatalf("DB init failed: %v", err)
+	}
+	defer db.Db.Close()
+
+	if err := handlers.SetRole(db.Db, username, role); err != nil {
+		log.Fatalf("Failed to set role: %v", err)
+	}
+	fmt.Printf("%s is now %s\n", username, role)
+}
+
+// verifyAudit checks the audit log's hash chain and exits non-zero if it
+// is broken. The head hash it prints can be kept elsewhere and compared
+// on the next run, to catch events deleted from the end.
+func verifyAudit(args []string) {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if err := db.InitDB(cfg.Database); err != nil {
+		log.Fatalf("DB init failed: %v", err)
+	}
+	defer db.Db.Close()
+
+	v, err := handlers.VerifyAudit(db.Db)
+	if err != nil {
+		log.Fatalf("Verification failed: %v", err)
+	}
+	if v.Problem != "" {
+		log.Fatalf("Audit log is broken after %d good events: %s", v.Events, v.Problem)
+	}
+	fmt.Printf("Audit log intact: %d events, head %s\n", v.Events, v.Head)
+}
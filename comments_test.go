@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"postSPA/db"
+	"testing"
+)
+
+// userCommentCount returns how many of username's comments viewer is
+// shown on their profile, and the total the listing reports.
+func userCommentCount(t *testing.T, viewer *testClient, username string) (int, int) {
+	t.Helper()
+	res := viewer.do("GET", "/api/v2/users/"+username+"/comments", nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("cannot list comments: %d %s", res.status, res.body)
+	}
+	var page struct {
+		Data       []struct{} `json:"data"`
+		Pagination struct {
+			Total int `json:"total"`
+		} `json:"pagination"`
+	}
+	res.decode(t, &page)
+	return len(page.Data), page.Pagination.Total
+}
+
+// TestUserCommentsFollowPostVisibility checks that a user's comment
+// listing leaves out comments on posts the viewer can't see: removed
+// posts, and posts whose author blocked or was muted by the viewer.
+func TestUserCommentsFollowPostVisibility(t *testing.T) {
+	srv := newTestServer(t, nil)
+	author := srv.user("author", "user")
+	commenter := srv.user("commenter", "user")
+	viewer := srv.user("viewer", "user")
+
+	removed := author.createPost("This will be removed")
+	kept := srv.user("other", "user").createPost("This stays")
+	for _, post := range []string{removed, kept} {
+		if res := commenter.do("POST", "/api/v2/posts/"+post+"/comments", map[string]string{"content": "A comment on " + post}); res.status != http.StatusCreated {
+			t.Fatalf("cannot comment: %d %s", res.status, res.body)
+		}
+	}
+	if shown, total := userCommentCount(t, viewer, "commenter"); shown != 2 || total != 2 {
+		t.Fatalf("before moderation: shown %d of %d comments, want 2 of 2", shown, total)
+	}
+
+	if _, err := db.Db.Exec("UPDATE posts SET moderation = 'removed' WHERE id = ?", removed); err != nil {
+		t.Fatal(err)
+	}
+	if shown, total := userCommentCount(t, viewer, "commenter"); shown != 1 || total != 1 {
+		t.Errorf("on a removed post: shown %d of %d comments, want 1 of 1", shown, total)
+	}
+	if shown, total := userCommentCount(t, srv.anonymous(), "commenter"); shown != 1 || total != 1 {
+		t.Errorf("anonymously: shown %d of %d comments, want 1 of 1", shown, total)
+	}
+
+	blocker := srv.user("blocker", "user")
+	blocked := blocker.createPost("The viewer is blocked from this")
+	if res := commenter.do("POST", "/api/v2/posts/"+blocked+"/comments", map[string]string{"content": "Visible to some"}); res.status != http.StatusCreated {
+		t.Fatalf("cannot comment: %d %s", res.status, res.body)
+	}
+	if res := blocker.do("PUT", "/api/v2/users/viewer/block", nil); res.status != http.StatusNoContent {
+		t.Fatalf("cannot block: %d %s", res.status, res.body)
+	}
+	if shown, total := userCommentCount(t, viewer, "commenter"); shown != 1 || total != 1 {
+		t.Errorf("on a post whose author blocked the viewer: shown %d of %d comments, want 1 of 1", shown, total)
+	}
+
+	if res := viewer.do("PUT", "/api/v2/users/other/mute", nil); res.status != http.StatusNoContent {
+		t.Fatalf("cannot mute: %d %s", res.status, res.body)
+	}
+	if shown, total := userCommentCount(t, viewer, "commenter"); shown != 0 || total != 0 {
+		t.Errorf("on a post whose author the viewer muted: shown %d of %d comments, want 0 of 0", shown, total)
+	}
+}
@@ -0,0 +1,345 @@
+// Package config holds the server settings. Values are resolved in
+// order: built-in defaults, then a YAML file, then POSTSPA_* environment
+// variables, then command-line flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Server   Server   `yaml:"server"`
+	Database Database `yaml:"database"`
+	Session  Session  `yaml:"session"`
+	Uploads  Uploads  `yaml:"uploads"`
+	Content  Content  `yaml:"content"`
+}
+
+type Server struct {
+	Addr        string `yaml:"addr"`
+	FrontendDir string `yaml:"frontend_dir"`
+
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// Read and write timeouts cover whole requests, so they must leave
+	// room for the largest upload on a slow connection
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes int           `yaml:"max_header_bytes"`
+	// How long in-flight requests get to finish on SIGINT/SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type Database struct {
+	Path       string `yaml:"path"`
+	SchemaFile string `yaml:"schema_file"`
+}
+
+type Session struct {
+	TTL time.Duration `yaml:"ttl"`
+}
+
+type Uploads struct {
+	Backend string `yaml:"backend"` // local or s3
+	Dir     string `yaml:"dir"`     // local backend only
+	S3      S3     `yaml:"s3"`
+
+	MaxSize        int64 `yaml:"max_size"` // bytes per image
+	MaxImages      int   `yaml:"max_images"`
+	MaxImagePixels int   `yaml:"max_image_pixels"`
+	// Longest edge, in pixels, of the generated variants
+	ThumbnailSize int `yaml:"thumbnail_size"`
+	MediumSize    int `yaml:"medium_size"`
+
+	GCInterval time.Duration `yaml:"gc_interval"`
+	// Unreferenced uploads younger than this may belong to a post that
+	// is still being created and are never collected
+	GCGrace time.Duration `yaml:"gc_grace"`
+}
+
+type S3 struct {
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Region    string `yaml:"region"`
+	UseSSL    bool   `yaml:"use_ssl"`
+	PublicURL string `yaml:"public_url"`
+}
+
+// Content configures the checks new posts and comments go through
+// before they are saved. A zero limit turns its check off.
+type Content struct {
+	BannedWords []BannedWord `yaml:"banned_words"`
+	MaxLinks    int          `yaml:"max_links"` // per post or comment
+	// Content identical to what the same user posted this recently is
+	// refused
+	DuplicateWindow time.Duration `yaml:"duplicate_window"`
+	// Accounts younger than NewAccountAge may post at most
+	// NewAccountLimit posts and comments per NewAccountWindow
+	NewAccountAge    time.Duration `yaml:"new_account_age"`
+	NewAccountLimit  int           `yaml:"new_account_limit"`
+	NewAccountWindow time.Duration `yaml:"new_account_window"`
+}
+
+// BannedWord is matched as a whole word, ignoring case. Mode is block
+// (refuse the content), mask (replace the word with asterisks) or
+// moderate (publish it hidden until a moderator approves it).
+type BannedWord struct {
+	Word string `yaml:"word"`
+	Mode string `yaml:"mode"`
+}
+
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:              ":8080",
+			FrontendDir:       "./frontend",
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       5 * time.Minute,
+			WriteTimeout:      5 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    1 << 20, // 1MB
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Database: Database{
+			Path:       "app.db",
+			SchemaFile: "schema/schema.sql",
+		},
+		Session: Session{
+			TTL: 24 * time.Hour,
+		},
+		Uploads: Uploads{
+			Backend:        "local",
+			Dir:            "./static/uploads",
+			MaxSize:        20 * 1024 * 1024, // 20MB
+			MaxImages:      10,
+			MaxImagePixels: 50_000_000,
+			ThumbnailSize:  200,
+			MediumSize:     800,
+			GCInterval:     6 * time.Hour,
+			GCGrace:        time.Hour,
+		},
+		Content: Content{
+			MaxLinks:         10,
+			DuplicateWindow:  24 * time.Hour,
+			NewAccountAge:    24 * time.Hour,
+			NewAccountLimit:  10,
+			NewAccountWindow: time.Hour,
+		},
+	}
+}
+
+// Load resolves the configuration for a command. Callers may register
+// their own flags on fs before calling; Load adds the config flags,
+// parses args and validates the result. With --print-config the
+// resolved configuration is written to stdout and the process exits.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+
+	// The file has to be read before flags are registered so that flag
+	// defaults reflect it, so find --config by hand first
+	path := os.Getenv("POSTSPA_CONFIG")
+	if p, ok := lookupArg(args, "config"); ok {
+		path = p
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.String("config", path, "path to a YAML config file (env POSTSPA_CONFIG)")
+	printConfig := fs.Bool("print-config", false, "print the resolved configuration and exit")
+	cfg.registerFlags(fs)
+
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Server.Addr, "addr", c.Server.Addr, "address to listen on")
+	fs.StringVar(&c.Server.FrontendDir, "frontend-dir", c.Server.FrontendDir, "directory with the frontend files")
+	fs.DurationVar(&c.Server.ReadHeaderTimeout, "read-header-timeout", c.Server.ReadHeaderTimeout, "time allowed to read request headers")
+	fs.DurationVar(&c.Server.ReadTimeout, "read-timeout", c.Server.ReadTimeout, "time allowed to read a whole request")
+	fs.DurationVar(&c.Server.WriteTimeout, "write-timeout", c.Server.WriteTimeout, "time allowed to write a response")
+	fs.DurationVar(&c.Server.IdleTimeout, "idle-timeout", c.Server.IdleTimeout, "how long idle keep-alive connections stay open")
+	fs.IntVar(&c.Server.MaxHeaderBytes, "max-header-bytes", c.Server.MaxHeaderBytes, "maximum size of request headers")
+	fs.DurationVar(&c.Server.ShutdownTimeout, "shutdown-timeout", c.Server.ShutdownTimeout, "time in-flight requests get to finish on shutdown")
+
+	fs.StringVar(&c.Database.Path, "db-path", c.Database.Path, "SQLite database file")
+	fs.StringVar(&c.Database.SchemaFile, "schema-file", c.Database.SchemaFile, "SQL schema applied at startup")
+
+	fs.DurationVar(&c.Session.TTL, "session-ttl", c.Session.TTL, "how long a login session lasts")
+
+	fs.StringVar(&c.Uploads.Backend, "upload-backend", c.Uploads.Backend, "upload storage: local or s3")
+	fs.StringVar(&c.Uploads.Dir, "upload-dir", c.Uploads.Dir, "directory for the local upload backend")
+	fs.Int64Var(&c.Uploads.MaxSize, "upload-max-size", c.Uploads.MaxSize, "maximum size of one image in bytes")
+	fs.IntVar(&c.Uploads.MaxImages, "upload-max-images", c.Uploads.MaxImages, "maximum images per post")
+	fs.IntVar(&c.Uploads.MaxImagePixels, "upload-max-image-pixels", c.Uploads.MaxImagePixels, "maximum width*height of an image, summed over the frames of a GIF")
+	fs.IntVar(&c.Uploads.ThumbnailSize, "thumbnail-size", c.Uploads.ThumbnailSize, "longest edge of thumbnails in pixels")
+	fs.IntVar(&c.Uploads.MediumSize, "medium-size", c.Uploads.MediumSize, "longest edge of medium images in pixels")
+	fs.DurationVar(&c.Uploads.GCInterval, "upload-gc-interval", c.Uploads.GCInterval, "how often unreferenced uploads are removed")
+	fs.DurationVar(&c.Uploads.GCGrace, "upload-gc-grace", c.Uploads.GCGrace, "keep unreferenced uploads younger than this")
+
+	fs.StringVar(&c.Uploads.S3.Endpoint, "s3-endpoint", c.Uploads.S3.Endpoint, "S3 endpoint host[:port]")
+	fs.StringVar(&c.Uploads.S3.Bucket, "s3-bucket", c.Uploads.S3.Bucket, "S3 bucket")
+	fs.StringVar(&c.Uploads.S3.AccessKey, "s3-access-key", c.Uploads.S3.AccessKey, "S3 access key")
+	fs.StringVar(&c.Uploads.S3.SecretKey, "s3-secret-key", c.Uploads.S3.SecretKey, "S3 secret key")
+	fs.StringVar(&c.Uploads.S3.Region, "s3-region", c.Uploads.S3.Region, "S3 region")
+	fs.BoolVar(&c.Uploads.S3.UseSSL, "s3-use-ssl", c.Uploads.S3.UseSSL, "connect to S3 over HTTPS")
+	fs.StringVar(&c.Uploads.S3.PublicURL, "s3-public-url", c.Uploads.S3.PublicURL, "public base URL of the bucket (optional)")
+
+	fs.IntVar(&c.Content.MaxLinks, "max-links", c.Content.MaxLinks, "most links in a post or comment (0 for no limit)")
+	fs.DurationVar(&c.Content.DuplicateWindow, "duplicate-window", c.Content.DuplicateWindow, "refuse content a user repeats within this long (0 to allow)")
+	fs.DurationVar(&c.Content.NewAccountAge, "new-account-age", c.Content.NewAccountAge, "accounts younger than this are rate limited")
+	fs.IntVar(&c.Content.NewAccountLimit, "new-account-limit", c.Content.NewAccountLimit, "posts and comments a new account may make per window (0 for no limit)")
+	fs.DurationVar(&c.Content.NewAccountWindow, "new-account-window", c.Content.NewAccountWindow, "window of the new account rate limit")
+}
+
+// applyEnv sets every config flag from its environment variable, named
+// POSTSPA_ plus the flag name in upper snake case (upload-dir becomes
+// POSTSPA_UPLOAD_DIR). Flags parsed afterwards still win.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		name := "POSTSPA_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// lookupArg finds -name value, -name=value or the -- forms in args.
+func lookupArg(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		trimmed := strings.TrimLeft(arg, "-")
+		if trimmed == arg {
+			continue
+		}
+		if v, ok := strings.CutPrefix(trimmed, name+"="); ok {
+			return v, true
+		}
+		if trimmed == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Server.FrontendDir != "", "server.frontend_dir is required")
+	check(c.Server.ReadHeaderTimeout > 0, "server.read_header_timeout must be positive")
+	check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout must be positive")
+	check(c.Server.MaxHeaderBytes > 0, "server.max_header_bytes must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Database.Path != "", "database.path is required")
+	check(c.Database.SchemaFile != "", "database.schema_file is required")
+	check(c.Session.TTL >= time.Minute, "session.ttl must be at least 1m, got %s", c.Session.TTL)
+
+	u := c.Uploads
+	check(u.MaxSize > 0, "uploads.max_size must be positive")
+	check(u.MaxImages > 0, "uploads.max_images must be positive")
+	check(u.MaxImagePixels > 0, "uploads.max_image_pixels must be positive")
+	check(u.ThumbnailSize > 0, "uploads.thumbnail_size must be positive")
+	check(u.MediumSize >= u.ThumbnailSize, "uploads.medium_size must not be smaller than uploads.thumbnail_size")
+	check(u.GCInterval > 0, "uploads.gc_interval must be positive")
+	check(u.GCGrace >= 0, "uploads.gc_grace must not be negative")
+
+	ct := c.Content
+	for i, bw := range ct.BannedWords {
+		check(strings.TrimSpace(bw.Word) != "", "content.banned_words[%d].word is required", i)
+		check(bw.Mode == "block" || bw.Mode == "mask" || bw.Mode == "moderate",
+			"content.banned_words[%d].mode must be block, mask or moderate, got %q", i, bw.Mode)
+	}
+	check(ct.MaxLinks >= 0, "content.max_links must not be negative")
+	check(ct.DuplicateWindow >= 0, "content.duplicate_window must not be negative")
+	check(ct.NewAccountAge >= 0, "content.new_account_age must not be negative")
+	check(ct.NewAccountLimit >= 0, "content.new_account_limit must not be negative")
+	check(ct.NewAccountWindow > 0, "content.new_account_window must be positive")
+
+	switch u.Backend {
+	case "local":
+		check(u.Dir != "", "uploads.dir is required for the local backend")
+	case "s3":
+		check(u.S3.Endpoint != "", "uploads.s3.endpoint is required for the s3 backend")
+		check(u.S3.Bucket != "", "uploads.s3.bucket is required for the s3 backend")
+	default:
+		check(false, "uploads.backend must be local or s3, got %q", u.Backend)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Print writes the configuration as YAML with secrets masked.
+func (c Config) Print(w io.Writer) error {
+	if c.Uploads.S3.SecretKey != "" {
+		c.Uploads.S3.SecretKey = "********"
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
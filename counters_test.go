@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"postSPA/config"
+	"postSPA/db"
+	"postSPA/handlers"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// counterDrift lists the posts and comments whose stored counts differ
+// from the rows they count.
+func counterDrift(t *testing.T) []string {
+	t.Helper()
+	rows, err := db.Db.Query(`
+		SELECT 'post ' || id, likes_count, dislikes_count, comments_count,
+			(SELECT COUNT(*) FROM reactions WHERE post_id = p.id AND type = 'like'),
+			(SELECT COUNT(*) FROM reactions WHERE post_id = p.id AND type = 'dislike'),
+			(SELECT COUNT(*) FROM comments WHERE post_id = p.id AND moderation IS NULL)
+		FROM posts p
+		UNION ALL
+		SELECT 'comment ' || id, likes_count, dislikes_count, 0,
+			(SELECT COUNT(*) FROM reactions WHERE comment_id = c.id AND type = 'like'),
+			(SELECT COUNT(*) FROM reactions WHERE comment_id = c.id AND type = 'dislike'),
+			0
+		FROM comments c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var drift []string
+	for rows.Next() {
+		var row string
+		var stored, counted [3]int
+		if err := rows.Scan(&row, &stored[0], &stored[1], &stored[2], &counted[0], &counted[1], &counted[2]); err != nil {
+			t.Fatal(err)
+		}
+		if stored != counted {
+			drift = append(drift, fmt.Sprintf("%s stores %v likes, dislikes and comments but has %v", row, stored, counted))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return drift
+}
+
+// TestCountersUnderConcurrency has several users react to and comment
+// on the same posts at the same time, then checks that the counts the
+// triggers keep match COUNT(*) of the rows.
+func TestCountersUnderConcurrency(t *testing.T) {
+	srv := newTestServer(t, func(cfg *config.Config) {
+		cfg.Content.DuplicateWindow = 0
+		cfg.Content.NewAccountAge = 0
+	})
+	author := srv.user("author", "user")
+	var posts []string
+	for i := range 3 {
+		posts = append(posts, author.createPost(fmt.Sprintf("Post %d", i)))
+	}
+
+	const users, rounds = 6, 8
+	var clients []*testClient
+	for i := range users {
+		clients = append(clients, srv.user(fmt.Sprintf("user%d", i), "user"))
+	}
+
+	start := make(chan struct{})
+	failures := make(chan string, users*rounds*len(posts)*2)
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for round := range rounds {
+				for _, post := range posts {
+					var method, path string
+					var body any
+					switch (i + round) % 4 {
+					case 0:
+						method, path, body = "POST", "/api/posts/"+post+"/react", map[string]string{"type": "like"}
+					case 1:
+						method, path, body = "PUT", "/api/v2/posts/"+post+"/reaction", map[string]string{"type": "dislike"}
+					case 2:
+						method, path = "DELETE", "/api/v2/posts/"+post+"/reaction"
+					case 3:
+						method, path, body = "POST", "/api/v2/posts/"+post+"/comments", map[string]string{"content": "Hello"}
+					}
+					res, err := c.send(method, path, body)
+					if err != nil {
+						failures <- err.Error()
+					} else if res.status >= 300 {
+						failures <- fmt.Sprintf("%s %s: %d %s", method, path, res.status, res.body)
+					}
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(failures)
+	for f := range failures {
+		t.Error(f)
+	}
+
+	for _, d := range counterDrift(t) {
+		t.Error(d)
+	}
+}
+
+// TestRecountRepairsDrift corrupts stored counts and checks that
+// Recount reports them, leaves them alone on a dry run and otherwise
+// repairs them and the post's score.
+func TestRecountRepairsDrift(t *testing.T) {
+	srv := newTestServer(t, nil)
+	author := srv.user("author", "user")
+	post := author.createPost("Count me")
+	fan := srv.user("fan", "user")
+	if res := fan.do("PUT", "/api/v2/posts/"+post+"/reaction", map[string]string{"type": "like"}); res.status != http.StatusOK {
+		t.Fatalf("cannot react: %d %s", res.status, res.body)
+	}
+	res := fan.do("POST", "/api/v2/posts/"+post+"/comments", map[string]string{"content": "Nice"})
+	if res.status != http.StatusCreated {
+		t.Fatalf("cannot comment: %d %s", res.status, res.body)
+	}
+	var comment struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	res.decode(t, &comment)
+	untouched := author.createPost("Leave me be")
+
+	var fanID string
+	if err := db.Db.QueryRow("SELECT id FROM users WHERE username = 'fan'").Scan(&fanID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec("INSERT INTO reactions (id, user_id, comment_id, type) VALUES (?, ?, ?, 'dislike')",
+		uuid.New().String(), fanID, comment.Data.ID); err != nil {
+		t.Fatal(err)
+	}
+	if drift := counterDrift(t); len(drift) > 0 {
+		t.Fatalf("counts drifted before the test corrupted them: %v", drift)
+	}
+
+	// Corrupt the counts the way a missed trigger would
+	if _, err := db.Db.Exec("UPDATE posts SET likes_count = 42, comments_count = 0, score = 42 WHERE id = ?", post); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec("UPDATE comments SET dislikes_count = 0 WHERE id = ?", comment.Data.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := handlers.Recount(db.Db, true)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if !report.DryRun || !slices.Equal(report.Posts, []string{post}) || !slices.Equal(report.Comments, []string{comment.Data.ID}) {
+		t.Errorf("dry run reported %+v, want post %s and comment %s", report, post, comment.Data.ID)
+	}
+	if drift := counterDrift(t); len(drift) != 2 {
+		t.Errorf("dry run changed the counts: %v", drift)
+	}
+
+	report, err = handlers.Recount(db.Db, false)
+	if err != nil {
+		t.Fatalf("recount failed: %v", err)
+	}
+	if report.DryRun || !slices.Equal(report.Posts, []string{post}) || !slices.Equal(report.Comments, []string{comment.Data.ID}) {
+		t.Errorf("recount reported %+v, want post %s and comment %s", report, post, comment.Data.ID)
+	}
+	if slices.Contains(report.Posts, untouched) {
+		t.Errorf("recount reported post %s, whose counts were right", untouched)
+	}
+	for _, d := range counterDrift(t) {
+		t.Errorf("after recount: %s", d)
+	}
+	var score int
+	if err := db.Db.QueryRow("SELECT score FROM posts WHERE id = ?", post).Scan(&score); err != nil {
+		t.Fatal(err)
+	}
+	if score != 1 {
+		t.Errorf("score is %d after recount, want 1", score)
+	}
+
+	report, err = handlers.Recount(db.Db, false)
+	if err != nil {
+		t.Fatalf("second recount failed: %v", err)
+	}
+	if len(report.Posts) > 0 || len(report.Comments) > 0 {
+		t.Errorf("second recount found drift again: %+v", report)
+	}
+}
+
+// TestCommentsCountFollowsModeration checks that a post's comment count
+// drops when a moderator hides a comment or a content check holds one,
+// and rises again when the held comment is approved.
+func TestCommentsCountFollowsModeration(t *testing.T) {
+	srv := newTestServer(t, func(cfg *config.Config) {
+		cfg.Content.BannedWords = []config.BannedWord{{Word: "heldword", Mode: handlers.VerdictModerate}}
+	})
+	post := srv.user("author", "user").createPost("Discuss")
+	commenter := srv.user("commenter", "user")
+	reporter := srv.user("reporter", "user")
+	mod := srv.user("mod", "moderator")
+
+	commentsCount := func() int {
+		t.Helper()
+		var got struct {
+			Data struct {
+				CommentsCount int `json:"comments_count"`
+			} `json:"data"`
+		}
+		srv.anonymous().do("GET", "/api/v2/posts/"+post, nil).decode(t, &got)
+		return got.Data.CommentsCount
+	}
+	comment := func(content string) string {
+		t.Helper()
+		res := commenter.do("POST", "/api/v2/posts/"+post+"/comments", map[string]string{"content": content})
+		if res.status != http.StatusCreated {
+			t.Fatalf("cannot comment: %d %s", res.status, res.body)
+		}
+		var created struct {
+			Data struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		res.decode(t, &created)
+		return created.Data.ID
+	}
+
+	hidden := comment("First")
+	comment("Second")
+	if n := commentsCount(); n != 2 {
+		t.Fatalf("comments_count is %d, want 2", n)
+	}
+
+	res := reporter.do("POST", "/api/v2/reports", map[string]string{"target_type": "comment", "target_id": hidden, "reason": "spam"})
+	if res.status != http.StatusCreated {
+		t.Fatalf("cannot report: %d %s", res.status, res.body)
+	}
+	var report struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	res.decode(t, &report)
+	res = mod.do("POST", "/api/v2/moderation/reports/"+report.Data.ID+"/resolution", map[string]string{"action": "hide"})
+	if res.status != http.StatusOK {
+		t.Fatalf("cannot hide comment: %d %s", res.status, res.body)
+	}
+	if n := commentsCount(); n != 1 {
+		t.Errorf("after hiding a comment comments_count is %d, want 1", n)
+	}
+
+	comment("This has a heldword")
+	if n := commentsCount(); n != 1 {
+		t.Errorf("after a comment was held comments_count is %d, want 1", n)
+	}
+	var holds struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	mod.do("GET", "/api/v2/moderation/holds", nil).decode(t, &holds)
+	if len(holds.Data) != 1 {
+		t.Fatalf("want 1 hold, got %d", len(holds.Data))
+	}
+	res = mod.do("POST", "/api/v2/moderation/holds/"+holds.Data[0].ID+"/resolution", map[string]string{"action": "approve"})
+	if res.status != http.StatusNoContent {
+		t.Fatalf("cannot approve hold: %d %s", res.status, res.body)
+	}
+	if n := commentsCount(); n != 2 {
+		t.Errorf("after approving the held comment comments_count is %d, want 2", n)
+	}
+
+	for _, d := range counterDrift(t) {
+		t.Error(d)
+	}
+}
@@ -5,21 +5,22 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"postSPA/config"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var Db *sql.DB
 
-// InitDB opens a connection to the DB and runs schema from schema/schema.sql
-func InitDB(path string, schemaFile string) error {
-	db, err := sql.Open("sqlite3", path)
+// InitDB opens a connection to the DB and runs the configured schema file
+func InitDB(cfg config.Database) error {
+	db, err := sql.Open("sqlite3", cfg.Path)
 	if err != nil {
 		return fmt.Errorf("cannot open database: %w", err)
 	}
 
 	// Load the schema from the .sql file
-	schemaBytes, err := os.ReadFile(schemaFile)
+	schemaBytes, err := os.ReadFile(cfg.SchemaFile)
 	if err != nil {
 		return fmt.Errorf("cannot read schema file: %w", err)
 	}
@@ -30,6 +31,11 @@ func InitDB(path string, schemaFile string) error {
 		return fmt.Errorf("cannot execute schema: %w", err)
 	}
 
+	// Bring databases created from an older schema up to date
+	if err := migrate(db); err != nil {
+		return fmt.Errorf("cannot migrate schema: %w", err)
+	}
+
 	Db = db
 	return nil
 }
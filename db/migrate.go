@@ -0,0 +1,129 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// columnMigrations lists columns added to existing tables after their
+// CREATE TABLE statement was first shipped. CREATE TABLE IF NOT EXISTS
+// leaves old tables untouched, so these are added with ALTER TABLE. The
+// optional backfill statement runs once, right after the column is added.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+	backfill   string
+}{
+	{"users", "role", "TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'))", ""},
+	{"users", "suspended_until", "DATETIME", ""},
+	{"users", "banned_at", "DATETIME", ""},
+	{"users", "suspension_reason", "TEXT", ""},
+	{"posts", "content_html", "TEXT", ""},
+	{"posts", "score", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"posts", "hot_score", "REAL", ""},
+	{"posts", "controversy_score", "REAL NOT NULL DEFAULT 0", ""},
+	{"posts", "likes_count", "INTEGER NOT NULL DEFAULT 0",
+		"UPDATE posts SET likes_count = (SELECT COUNT(*) FROM reactions WHERE post_id = posts.id AND type = 'like')"},
+	{"posts", "dislikes_count", "INTEGER NOT NULL DEFAULT 0",
+		"UPDATE posts SET dislikes_count = (SELECT COUNT(*) FROM reactions WHERE post_id = posts.id AND type = 'dislike')"},
+	{"posts", "comments_count", "INTEGER NOT NULL DEFAULT 0",
+		"UPDATE posts SET comments_count = (SELECT COUNT(*) FROM comments WHERE post_id = posts.id)"},
+	{"posts", "moderation", "TEXT CHECK (moderation IN ('hidden', 'removed'))", ""},
+	{"comments", "likes_count", "INTEGER NOT NULL DEFAULT 0",
+		"UPDATE comments SET likes_count = (SELECT COUNT(*) FROM reactions WHERE comment_id = comments.id AND type = 'like')"},
+	{"comments", "dislikes_count", "INTEGER NOT NULL DEFAULT 0",
+		"UPDATE comments SET dislikes_count = (SELECT COUNT(*) FROM reactions WHERE comment_id = comments.id AND type = 'dislike')"},
+	{"comments", "moderation", "TEXT CHECK (moderation IN ('hidden', 'removed'))", ""},
+}
+
+// indexMigrations create indexes on migrated columns or on data that
+// dataMigrations clean up first. They run last, since schema.sql runs
+// before the columns exist on old databases.
+var indexMigrations = []string{
+	// One per feed sort order, matching its ORDER BY
+	"CREATE INDEX IF NOT EXISTS idx_posts_created_at ON posts(created_at, id)",
+	"CREATE INDEX IF NOT EXISTS idx_posts_score ON posts(score, created_at, id)",
+	"CREATE INDEX IF NOT EXISTS idx_posts_hot_score ON posts(hot_score, id)",
+	"CREATE INDEX IF NOT EXISTS idx_posts_controversy_score ON posts(controversy_score, created_at, id)",
+
+	// One reaction per user and target. The table's UNIQUE constraint
+	// can't enforce this, because NULLs in it never compare equal
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_reactions_user_post ON reactions(user_id, post_id) WHERE comment_id IS NULL",
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_reactions_user_comment ON reactions(user_id, comment_id) WHERE post_id IS NULL",
+}
+
+// dataMigrations backfill rows for features added after data existed.
+// Each statement must be safe to run on every start.
+var dataMigrations = []string{
+	// Posts from before galleries get their single image as post_media,
+	// which also gives the image a reference count in uploads
+	`INSERT INTO post_media (post_id, position, image_path, alt_text)
+	SELECT id, 0, image_path, ''
+	FROM posts
+	WHERE image_path IS NOT NULL
+		AND id NOT IN (SELECT post_id FROM post_media)`,
+
+	// Duplicate reactions left by racing requests would block the unique
+	// reaction indexes; keep the first of each. The counter triggers
+	// discount the deleted rows
+	`DELETE FROM reactions
+	WHERE rowid NOT IN (
+		SELECT MIN(rowid) FROM reactions GROUP BY user_id, post_id, comment_id
+	)`,
+
+	// comments_count used to count moderated comments too. Recount it
+	// once, while the triggers that did so are still there to tell that
+	// it's needed, then drop them for the visible_comments_count ones
+	`UPDATE posts
+	SET comments_count = (SELECT COUNT(*) FROM comments WHERE post_id = posts.id AND moderation IS NULL)
+	WHERE EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'trigger' AND name = 'comments_count_insert')`,
+	"DROP TRIGGER IF EXISTS comments_count_insert",
+	"DROP TRIGGER IF EXISTS comments_count_delete",
+}
+
+func migrate(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		added, err := addColumnIfMissing(db, m.table, m.column, m.definition)
+		if err != nil {
+			return err
+		}
+		if added && m.backfill != "" {
+			if _, err := db.Exec(m.backfill); err != nil {
+				return fmt.Errorf("failed to backfill %s.%s: %w", m.table, m.column, err)
+			}
+		}
+	}
+
+	for _, stmt := range dataMigrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to backfill data: %w", err)
+		}
+	}
+
+	for _, stmt := range indexMigrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing reports whether it added the column.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).
+		Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s: %w", table, err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return false, fmt.Errorf("failed to add %s.%s: %w", table, column, err)
+	}
+	return true, nil
+}
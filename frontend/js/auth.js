@@ -1,4 +1,5 @@
 import { loadPosts, setupPostForm } from './posts.js'
+import { problemMessage } from './ui.js'
 
 export function setupAuthForms() {
     const registerForm = document.getElementById('register')
@@ -21,8 +22,7 @@ export function setupAuthForms() {
                 })
 
                 if (!response.ok) {
-                    const error = await response.json()
-                    document.getElementById('register-error').textContent = error.message || 'Registration failed'
+                    document.getElementById('register-error').textContent = await problemMessage(response, 'Registration failed')
                     return
                 }
 
@@ -54,8 +54,7 @@ export function setupAuthForms() {
                 })
 
                 if (!response.ok) {
-                    const error = await response.json()
-                    document.getElementById('login-error').textContent = error.message || 'Login failed'
+                    document.getElementById('login-error').textContent = await problemMessage(response, 'Login failed')
                     return
                 }
 
@@ -1,3 +1,5 @@
+import { escapeHtml } from './ui.js'
+
 export function setupCommentForm() {
     document.addEventListener('submit', async (e) => {
         if (e.target.matches('.comment-form')) {
@@ -59,6 +61,7 @@ async function revealComments(postId) {
             commentsList.innerHTML = comments.map(comment => `
                 <div class="user-comment-container">
                     <p class="commenter">By <span>${comment.username}</span></p>
+                    ${comment.moderationNotice ? `<p class="moderation-notice">${escapeHtml(comment.moderationNotice)}</p>` : ''}
                     <p class="user-comment-content">${comment.content}</p>
                     <p class="comment-created-time">${comment.createdAt}</p>
                 </div>
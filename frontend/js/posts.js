@@ -1,3 +1,5 @@
+import { escapeHtml, problemMessage } from './ui.js';
+
 async function loadCategories() {
     try {
         const response = await fetch('/api/categories', {
@@ -107,7 +109,7 @@ export function setupPostForm() {
         e.preventDefault();
 
         const content = document.getElementById('post-content').value.trim();
-        const imageFile = document.getElementById('post-image').files[0];
+        const imageFiles = document.getElementById('post-image').files;
         const checkedCategories = document.querySelectorAll('#category-selector input:checked')
 
         // Clear previous errors
@@ -129,9 +131,10 @@ export function setupPostForm() {
             checkedCategories.forEach(checkbox => {
                 formData.append('categories', checkbox.value);
             });
-            if (imageFile) {
-                // Handle image upload
+            // Handle image uploads, the server keeps them in this order
+            for (const imageFile of imageFiles) {
                 formData.append('image', imageFile);
+                formData.append('alt', '');
             }
 
             const response = await fetch('/api/posts/create', {
@@ -141,8 +144,7 @@ export function setupPostForm() {
             })
 
             if (!response.ok) {
-                const error = await response.json().catch(() => ({ message: 'Unknown error' }));
-                postError.textContent = error.message || 'Failed to create post';
+                postError.textContent = await problemMessage(response, 'Failed to create post');
                 return;
             }
 
@@ -196,13 +198,10 @@ export async function loadPosts() {
                         <h3 class="post-username">${post.username}</h3>
                         <small class="post-time">${formatDate(post.created_at)}</small>
                     </div>
+                    ${renderModerationNotice(post)}
                     <div class="post-content">
-                        <p>${escapeHtml(post.content)}</p>
-                        ${post.image_path ? `
-                            <div class="post-image">
-                                <img src="/uploads/${post.image_path}" alt="Post image">
-                            </div>
-                        ` : ''}
+                        ${renderPostContent(post)}
+                        ${renderPostImage(post)}
                     </div>
 
                     ${post.categories.length > 0 ? 
@@ -215,10 +214,10 @@ export async function loadPosts() {
                 </div>
 
                 <div class="post-actions">
-                    <button class="like-btn" data-post-id="${post.id}">
+                    <button class="like-btn${post.user_reaction === 'like' ? ' active' : ''}" data-post-id="${post.id}">
                         <span class="like-count">${post.likes_count}</span> Likes
                     </button>
-                    <button class="dislike-btn" data-post-id="${post.id}">
+                    <button class="dislike-btn${post.user_reaction === 'dislike' ? ' active' : ''}" data-post-id="${post.id}">
                         <span class="dislike-count">${post.dislikes_count}</span> Dislikes
                     </button>
                     <button class="comment-btn" data-post-id="${post.id}">
@@ -268,13 +267,10 @@ async function addPostToUI(post) {
                 <h3 class="post-username">${post.username}</h3>
                 <small class="post-time">${formatDate(post.created_at)}</small>
             </div>
+            ${renderModerationNotice(post)}
             <div class="post-content">
-                <p>${escapeHtml(post.content)}</p>
-                ${post.image_path ? `
-                    <div class="post-image">
-                        <img src="/uploads/${post.image_path}" alt="Post image">
-                    </div>
-                ` : ''}
+                ${renderPostContent(post)}
+                ${renderPostImage(post)}
             </div>
 
             ${categoriesHtml}
@@ -363,11 +359,30 @@ function formatDate(dateString) {
     return date.toLocaleString();
 }
 
-function escapeHtml(unsafe) {
-    return unsafe
-        .replace(/&/g, "&amp;")
-        .replace(/</g, "&lt;")
-        .replace(/>/g, "&gt;")
-        .replace(/"/g, "&quot;")
-        .replace(/'/g, "&#039;");
-}
\ No newline at end of file
+// Prefer the medium variant and reserve its size to avoid layout shift
+function renderPostImage(post) {
+    const media = post.media && post.media.length > 0
+        ? post.media
+        : post.image_path ? [{ image_path: post.image_path, alt_text: '', variants: post.image_variants || {} }] : [];
+    if (media.length === 0) return '';
+
+    return `<div class="post-image">${media.map(item => {
+        const variant = item.variants.medium || item.variants.original;
+        const alt = escapeHtml(item.alt_text || 'Post image');
+        return variant
+            ? `<img src="${variant.url}" width="${variant.width}" height="${variant.height}" alt="${alt}">`
+            : `<img src="/uploads/${item.image_path}" alt="${alt}">`;
+    }).join('')}</div>`;
+}
+
+// content_html is rendered from Markdown and sanitized by the server
+function renderPostContent(post) {
+    return post.content_html || `<p>${escapeHtml(post.content)}</p>`;
+}
+
+// Only the author sees their hidden posts, with the moderator's notice
+function renderModerationNotice(post) {
+    return post.moderation_notice
+        ? `<p class="moderation-notice">${escapeHtml(post.moderation_notice)}</p>`
+        : '';
+}
@@ -4,3 +4,23 @@ export function setHeadingText(text) {
         heading.textContent = text
     }
 }
+
+// Turns an application/problem+json error body into one line of text,
+// preferring the per-field messages when the server sent them.
+export async function problemMessage(response, fallback) {
+    const problem = await response.json().catch(() => ({}))
+    if (problem.errors && problem.errors.length > 0) {
+        return problem.errors.map(e => e.message).join('. ')
+    }
+    return problem.detail || fallback
+}
+
+// Escapes text for use in HTML built as a string
+export function escapeHtml(unsafe) {
+    return unsafe
+        .replace(/&/g, "&amp;")
+        .replace(/</g, "&lt;")
+        .replace(/>/g, "&gt;")
+        .replace(/"/g, "&quot;")
+        .replace(/'/g, "&#039;")
+}
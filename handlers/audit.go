@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"postSPA/problem"
+	"strings"
+	"time"
+)
+
+// Audited actions. Their targets are users, posts, comments or reports;
+// details hold whatever else is needed to read the event on its own.
+const (
+	AuditRegister       = "user.register"
+	AuditLogin          = "session.login"
+	AuditLoginFailed    = "session.login_failed"
+	AuditLogout         = "session.logout"
+	AuditRoleChange     = "user.role_change"
+	AuditWarn           = "user.warn"
+	AuditSuspend        = "account.suspend"
+	AuditBan            = "account.ban"
+	AuditReinstate      = "account.reinstate"
+	AuditPostCreate     = "post.create"
+	AuditPostUpdate     = "post.update"
+	AuditContentHide    = "content.hide"
+	AuditContentRemove  = "content.remove"
+	AuditContentHold    = "content.hold"
+	AuditContentApprove = "content.approve"
+	AuditReportCreate   = "report.create"
+	AuditReportResolve  = "report.resolve"
+)
+
+// auditGenesisHash stands in for the hash before the first event.
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// AuditEvent is one row of the audit log. Seq numbers events from 1 in
+// the order they happened.
+type AuditEvent struct {
+	Seq        int64           `json:"seq"`
+	ActorID    *string         `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	IP         string          `json:"ip"`
+	UserAgent  string          `json:"user_agent"`
+	Details    json.RawMessage `json:"details"`
+	CreatedAt  time.Time       `json:"created_at"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// auditEntry is what the code performing an action knows about it.
+type auditEntry struct {
+	actorID    string // "" for the command line
+	action     string
+	targetType string
+	targetID   string
+	details    map[string]any
+}
+
+// auditWriter is satisfied by both *sql.Tx and *sql.Conn.
+type auditWriter interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// recordAudit appends e to the audit log in tx, the transaction of the
+// action it describes, with the IP address and user agent of r. Call it
+// after the action's own writes: they hold SQLite's write lock, so no
+// other event can be appended between reading the last hash and
+// inserting this one. The caller must fail the request on an error, so
+// that no action commits without its event.
+func recordAudit(tx *sql.Tx, r *http.Request, e auditEntry) error {
+	ip, userAgent := requestOrigin(r)
+	return appendAuditEvent(r.Context(), tx, e, ip, userAgent)
+}
+
+// recordAuditAlone appends e in a transaction of its own, for attempts
+// that change nothing else, such as a failed login.
+func recordAuditAlone(db *sql.DB, r *http.Request, e auditEntry) error {
+	ctx := r.Context()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// BEGIN IMMEDIATE takes the write lock before reading the last hash.
+	// A plain transaction would take it only at the INSERT, and fail
+	// instead of waiting if another connection wrote in between
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return fmt.Errorf("cannot lock the audit log: %w", err)
+	}
+	ip, userAgent := requestOrigin(r)
+	if err := appendAuditEvent(ctx, conn, e, ip, userAgent); err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return fmt.Errorf("cannot commit audit event: %w", err)
+	}
+	return nil
+}
+
+// requestOrigin returns the IP address and user agent of r.
+func requestOrigin(r *http.Request) (string, string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return ip, r.UserAgent()
+}
+
+// appendAuditEvent chains e onto the last event in w, which must already
+// hold the write lock. seq is the table's primary key, so an append that
+// raced another one anyway fails rather than forking the chain.
+func appendAuditEvent(ctx context.Context, w auditWriter, e auditEntry, ip, userAgent string) error {
+	details := []byte("{}")
+	if len(e.details) > 0 {
+		var err error
+		if details, err = json.Marshal(e.details); err != nil {
+			return fmt.Errorf("cannot encode audit details: %w", err)
+		}
+	}
+	ev := AuditEvent{
+		Action:     e.action,
+		TargetType: e.targetType,
+		TargetID:   e.targetID,
+		IP:         ip,
+		UserAgent:  userAgent,
+		Details:    details,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if e.actorID != "" {
+		ev.ActorID = &e.actorID
+	}
+
+	ev.PrevHash = auditGenesisHash
+	err := w.QueryRowContext(ctx, "SELECT seq, hash FROM audit_events ORDER BY seq DESC LIMIT 1").
+		Scan(&ev.Seq, &ev.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("cannot read the last audit event: %w", err)
+	}
+	ev.Seq++
+	ev.Hash = auditHash(ev)
+
+	_, err = w.ExecContext(ctx, `
+		INSERT INTO audit_events
+			(seq, actor_id, action, target_type, target_id, ip, user_agent, details, created_at, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ev.Seq, ev.ActorID, ev.Action, ev.TargetType, ev.TargetID, ev.IP, ev.UserAgent,
+		string(ev.Details), ev.CreatedAt, ev.PrevHash, ev.Hash)
+	if err != nil {
+		return fmt.Errorf("cannot insert audit event: %w", err)
+	}
+	return nil
+}
+
+// auditHash is the SHA-256 of every stored field of ev but Hash itself,
+// encoded as a JSON array so no two different rows hash the same input.
+func auditHash(ev AuditEvent) string {
+	fields, _ := json.Marshal([]any{ev.PrevHash, ev.Seq, ev.ActorID, ev.Action, ev.TargetType, ev.TargetID,
+		ev.IP, ev.UserAgent, string(ev.Details), ev.CreatedAt.UTC().Format(time.RFC3339Nano)})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditVerification is the result of checking the audit log's hash
+// chain. Problem is empty if the chain is intact; Head is the hash of
+// the last event, worth keeping elsewhere, since the chain alone can't
+// tell whether events were cut off the end.
+type AuditVerification struct {
+	Events  int
+	Head    string
+	Problem string
+}
+
+// VerifyAudit walks the audit log in order and stops at the first event
+// that was changed, inserted or deleted out of sequence.
+func VerifyAudit(db *sql.DB) (AuditVerification, error) {
+	rows, err := db.Query("SELECT " + auditColumns + " FROM audit_events ORDER BY seq")
+	if err != nil {
+		return AuditVerification{}, err
+	}
+	defer rows.Close()
+
+	v := AuditVerification{Head: auditGenesisHash}
+	for rows.Next() {
+		ev, err := scanAuditEvent(rows)
+		if err != nil {
+			return AuditVerification{}, fmt.Errorf("cannot read audit event: %w", err)
+		}
+		switch {
+		case ev.Seq != int64(v.Events)+1:
+			v.Problem = fmt.Sprintf("expected event %d, found %d", v.Events+1, ev.Seq)
+		case ev.PrevHash != v.Head:
+			v.Problem = fmt.Sprintf("event %d does not follow event %d", ev.Seq, v.Events)
+		case ev.Hash != auditHash(ev):
+			v.Problem = fmt.Sprintf("event %d was modified", ev.Seq)
+		}
+		if v.Problem != "" {
+			return v, nil
+		}
+		v.Events++
+		v.Head = ev.Hash
+	}
+	return v, rows.Err()
+}
+
+const auditColumns = "seq, actor_id, action, target_type, target_id, ip, user_agent, details, created_at, prev_hash, hash"
+
+func scanAuditEvent(row rowScanner) (AuditEvent, error) {
+	var ev AuditEvent
+	var actorID sql.NullString
+	var details string
+	err := row.Scan(&ev.Seq, &actorID, &ev.Action, &ev.TargetType, &ev.TargetID, &ev.IP, &ev.UserAgent,
+		&details, &ev.CreatedAt, &ev.PrevHash, &ev.Hash)
+	ev.ActorID = nullString(actorID)
+	ev.Details = json.RawMessage(details)
+	return ev, err
+}
+
+// auditFilter narrows an audit log listing. Empty fields do not apply.
+type auditFilter struct {
+	actorID    string
+	action     string
+	targetType string
+	targetID   string
+	since      time.Time
+	until      time.Time
+}
+
+// readAuditFilter parses the filters of the audit log listing. since
+// and until are RFC 3339 times; since is inclusive, until exclusive.
+func readAuditFilter(w http.ResponseWriter, r *http.Request) (auditFilter, bool) {
+	q := r.URL.Query()
+	f := auditFilter{
+		actorID:    q.Get("actor_id"),
+		action:     q.Get("action"),
+		targetType: q.Get("target_type"),
+		targetID:   q.Get("target_id"),
+	}
+
+	var fields []problem.FieldError
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &f.since}, {"until", &f.until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				fields = append(fields, problem.FieldError{Field: p.name, Code: problem.FieldInvalid,
+					Message: p.name + " must be an RFC 3339 time, such as 2025-01-02T15:04:05Z"})
+				continue
+			}
+			*p.dest = t.UTC()
+		}
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, r, fields...)
+		return auditFilter{}, false
+	}
+	return f, true
+}
+
+// listAuditEvents returns a page of the events f selects, newest first,
+// and how many there are.
+func listAuditEvents(db *sql.DB, f auditFilter, limit, offset int) ([]AuditEvent, int, error) {
+	var where []string
+	var args []any
+	for _, c := range []struct{ column, value string }{
+		{"actor_id", f.actorID}, {"action", f.action}, {"target_type", f.targetType}, {"target_id", f.targetID},
+	} {
+		if c.value != "" {
+			where = append(where, c.column+" = ?")
+			args = append(args, c.value)
+		}
+	}
+	if !f.since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.since)
+	}
+	if !f.until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.until)
+	}
+	clause := ""
+	if len(where) > 0 {
+		clause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_events"+clause, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("cannot count audit events: %w", err)
+	}
+
+	rows, err := db.Query("SELECT "+auditColumns+" FROM audit_events"+clause+`
+		ORDER BY seq DESC
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		ev, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot read audit event row: %w", err)
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot list audit events: %w", err)
+	}
+	return events, total, nil
+}
@@ -3,17 +3,27 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"postSPA/config"
+	"postSPA/problem"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	maxUsernameLength = 32
+	maxPasswordLength = 72
+)
+
 type User struct {
 	ID           string `json:"id"`
 	Username     string `json:"username"`
 	PasswordHash string `json:"-"`
+	Role         string `json:"-"`
 }
 
 type AuthRequest struct {
@@ -29,165 +39,298 @@ type Session struct {
 
 func RegisterHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		var req AuthRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
-		if err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-
-		// Check if username exists
-		var existingID string
-		err = db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&existingID)
-		if err == nil {
-			http.Error(w, "Username already exists", http.StatusConflict)
-			return
-		} else if err != sql.ErrNoRows {
-			http.Error(w, "Database error", http.StatusInternalServerError)
+		if _, ok := registerUser(w, r, db); !ok {
 			return
 		}
+		writeJSON(w, http.StatusCreated, map[string]string{"message": "User created successfully"})
+	}
+}
 
-		// Hash password
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-		if err != nil {
-			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+func LoginHandler(db *sql.DB, session config.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := startSession(w, r, db, session); !ok {
 			return
 		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "Login successful"})
+	}
+}
 
-		// Create user
-		userID := uuid.New().String()
-		_, err = db.Exec("INSERT INTO users (id, username, password_hash) VALUES (?, ?, ?)",
-			userID, req.Username, string(hashedPassword))
-		if err != nil {
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+func LogoutHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !endSession(w, r, db) {
 			return
 		}
-
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]string{"message": "User created successfully"})
+		writeJSON(w, http.StatusOK, map[string]string{"message": "Logout successful"})
 	}
 }
 
-func LoginHandler(db *sql.DB) http.HandlerFunc {
+func AuthCheckHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		if _, _, ok := currentSession(w, r, db); !ok {
 			return
 		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "Authenticated"})
+	}
+}
 
-		var req AuthRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
-		if err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
+// The functions below hold the logic shared by every API version. Each
+// one either succeeds and returns ok, or writes the error response
+// itself; the version-specific handler then only shapes the success.
 
-		// Get user
-		var user User
-		err = db.QueryRow("SELECT id, username, password_hash FROM users WHERE username = ?", req.Username).
-			Scan(&user.ID, &user.Username, &user.PasswordHash)
-		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		} else if err != nil {
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
+// registerUser creates an account from the credentials in the body.
+func registerUser(w http.ResponseWriter, r *http.Request, db *sql.DB) (User, bool) {
+	var req AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeInvalidBody(w, r)
+		return User{}, false
+	}
 
-		// Check password
-		err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password))
-		if err != nil {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		}
+	if fields := validateCredentials(req); len(fields) > 0 {
+		writeValidationError(w, r, fields...)
+		return User{}, false
+	}
 
-		// Create session
-		sessionID := uuid.New().String()
-		expiresAt := time.Now().Add(24 * time.Hour)
-		_, err = db.Exec("INSERT INTO sessions (id, user_id, expires_at) VALUES (?, ?, ?)",
-			sessionID, user.ID, expiresAt)
-		if err != nil {
-			http.Error(w, "Failed to create session", http.StatusInternalServerError)
-			return
-		}
+	// Check if username exists
+	var existingID string
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&existingID)
+	if err == nil {
+		writeError(w, r, http.StatusConflict, problem.CodeConflict, "Username already exists")
+		return User{}, false
+	} else if err != sql.ErrNoRows {
+		writeInternalError(w, r, "error checking username", err)
+		return User{}, false
+	}
 
-		// Set cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_id",
-			Value:    sessionID,
-			Expires:  expiresAt,
-			HttpOnly: true,
-			Path:     "/",
-		})
+	// Hash password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeInternalError(w, r, "error hashing password", err)
+		return User{}, false
+	}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
+	// Create user
+	user := User{ID: uuid.New().String(), Username: req.Username}
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return User{}, false
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO users (id, username, password_hash) VALUES (?, ?, ?)",
+		user.ID, user.Username, string(hashedPassword))
+	if err != nil {
+		writeInternalError(w, r, "error creating user", err)
+		return User{}, false
+	}
+	err = recordAudit(tx, r, auditEntry{actorID: user.ID, action: AuditRegister, targetType: "user", targetID: user.ID})
+	if err != nil {
+		writeInternalError(w, r, "error recording audit event", err)
+		return User{}, false
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error creating user", err)
+		return User{}, false
 	}
+	return user, true
 }
 
-func LogoutHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_id")
+// startSession checks the credentials in the body and sets the session
+// cookie.
+func startSession(w http.ResponseWriter, r *http.Request, db *sql.DB, cfg config.Session) (User, Session, bool) {
+	var req AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeInvalidBody(w, r)
+		return User{}, Session{}, false
+	}
+
+	// Get user
+	var user User
+	var st standing
+	err := db.QueryRow(`
+		SELECT u.id, u.username, u.password_hash, u.role, `+standingColumns+`
+		FROM users u
+		WHERE u.username = ?`, req.Username).
+		Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role,
+			&st.suspendedUntil, &st.bannedAt, &st.reason)
+	if err == sql.ErrNoRows {
+		err := recordAuditAlone(db, r, auditEntry{action: AuditLoginFailed,
+			details: map[string]any{"username": req.Username, "reason": "unknown_user"}})
 		if err != nil {
-			http.Error(w, "Not logged in", http.StatusBadRequest)
-			return
+			writeInternalError(w, r, "error recording audit event", err)
+			return User{}, Session{}, false
 		}
+		writeError(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid credentials")
+		return User{}, Session{}, false
+	} else if err != nil {
+		writeInternalError(w, r, "error loading user", err)
+		return User{}, Session{}, false
+	}
 
-		_, err = db.Exec("DELETE FROM sessions WHERE id = ?", cookie.Value)
+	// Check password
+	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password))
+	if err != nil {
+		err := recordAuditAlone(db, r, auditEntry{action: AuditLoginFailed, targetType: "user", targetID: user.ID,
+			details: map[string]any{"username": req.Username, "reason": "wrong_password"}})
 		if err != nil {
-			http.Error(w, "Failed to logout", http.StatusInternalServerError)
-			return
+			writeInternalError(w, r, "error recording audit event", err)
+			return User{}, Session{}, false
 		}
+		writeError(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid credentials")
+		return User{}, Session{}, false
+	}
 
-		// Clear cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_id",
-			Value:    "",
-			Expires:  time.Unix(0, 0),
-			HttpOnly: true,
-			Path:     "/",
-		})
+	// Only tell the real owner about a suspension or ban
+	if detail := st.lockout(); detail != "" {
+		err := recordAuditAlone(db, r, auditEntry{action: AuditLoginFailed, targetType: "user", targetID: user.ID,
+			details: map[string]any{"username": req.Username, "reason": "locked_out"}})
+		if err != nil {
+			writeInternalError(w, r, "error recording audit event", err)
+			return User{}, Session{}, false
+		}
+		writeError(w, r, http.StatusForbidden, problem.CodeForbidden, detail)
+		return User{}, Session{}, false
+	}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Logout successful"})
+	// Create session
+	session := Session{ID: uuid.New().String(), UserID: user.ID, ExpiresAt: time.Now().Add(cfg.TTL)}
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return User{}, Session{}, false
 	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO sessions (id, user_id, expires_at) VALUES (?, ?, ?)",
+		session.ID, session.UserID, session.ExpiresAt)
+	if err != nil {
+		writeInternalError(w, r, "error creating session", err)
+		return User{}, Session{}, false
+	}
+	err = recordAudit(tx, r, auditEntry{actorID: user.ID, action: AuditLogin, targetType: "user", targetID: user.ID})
+	if err != nil {
+		writeInternalError(w, r, "error recording audit event", err)
+		return User{}, Session{}, false
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error creating session", err)
+		return User{}, Session{}, false
+	}
+
+	// Set cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_id",
+		Value:    session.ID,
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Path:     "/",
+	})
+	return user, session, true
 }
 
-func AuthCheckHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+// endSession deletes the caller's session and clears the cookie.
+func endSession(w http.ResponseWriter, r *http.Request, db *sql.DB) bool {
+	cookie, err := r.Cookie("session_id")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Not logged in")
+		return false
+	}
 
-		cookie, err := r.Cookie("session_id")
+	// Only a session that existed is worth auditing
+	var userID string
+	err = db.QueryRow("SELECT user_id FROM sessions WHERE id = ?", cookie.Value).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		writeInternalError(w, r, "error loading session", err)
+		return false
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return false
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM sessions WHERE id = ?", cookie.Value)
+	if err != nil {
+		writeInternalError(w, r, "error deleting session", err)
+		return false
+	}
+	if userID != "" {
+		err := recordAudit(tx, r, auditEntry{actorID: userID, action: AuditLogout, targetType: "user", targetID: userID})
 		if err != nil {
-			http.Error(w, "Not authenticated", http.StatusUnauthorized)
-			return
+			writeInternalError(w, r, "error recording audit event", err)
+			return false
 		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error deleting session", err)
+		return false
+	}
 
-		var session Session
-		err = db.QueryRow("SELECT id, user_id, expires_at FROM sessions WHERE id = ?", cookie.Value).
-			Scan(&session.ID, &session.UserID, &session.ExpiresAt)
-		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid session", http.StatusUnauthorized)
-			return
-		} else if err != nil {
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
+	// Clear cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_id",
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		Path:     "/",
+	})
+	return true
+}
 
-		if time.Now().After(session.ExpiresAt) {
-			http.Error(w, "Session expired", http.StatusUnauthorized)
-			return
-		}
+// currentSession returns the caller's session if it is still valid.
+func currentSession(w http.ResponseWriter, r *http.Request, db *sql.DB) (User, Session, bool) {
+	cookie, err := r.Cookie("session_id")
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Not authenticated")
+		return User{}, Session{}, false
+	}
+
+	var user User
+	var session Session
+	var st standing
+	err = db.QueryRow(`
+		SELECT s.id, s.user_id, s.expires_at, u.username, u.role, `+standingColumns+`
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = ?`, cookie.Value).
+		Scan(&session.ID, &session.UserID, &session.ExpiresAt, &user.Username, &user.Role,
+			&st.suspendedUntil, &st.bannedAt, &st.reason)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid session")
+		return User{}, Session{}, false
+	} else if err != nil {
+		writeInternalError(w, r, "error loading session", err)
+		return User{}, Session{}, false
+	}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Authenticated"})
+	if time.Now().After(session.ExpiresAt) {
+		writeError(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "Session expired")
+		return User{}, Session{}, false
+	}
+	if detail := st.lockout(); detail != "" {
+		writeError(w, r, http.StatusForbidden, problem.CodeForbidden, detail)
+		return User{}, Session{}, false
+	}
+	user.ID = session.UserID
+	return user, session, true
+}
+
+// validateCredentials checks a registration request. Passwords are
+// capped at bcrypt's 72-byte input limit.
+func validateCredentials(req AuthRequest) []problem.FieldError {
+	var fields []problem.FieldError
+	switch {
+	case strings.TrimSpace(req.Username) == "":
+		fields = append(fields, problem.FieldError{Field: "username", Code: problem.FieldRequired, Message: "Username is required"})
+	case len(req.Username) > maxUsernameLength:
+		fields = append(fields, problem.FieldError{Field: "username", Code: problem.FieldTooLong,
+			Message: fmt.Sprintf("Username can be at most %d characters", maxUsernameLength)})
+	}
+	switch {
+	case req.Password == "":
+		fields = append(fields, problem.FieldError{Field: "password", Code: problem.FieldRequired, Message: "Password is required"})
+	case len(req.Password) > maxPasswordLength:
+		fields = append(fields, problem.FieldError{Field: "password", Code: problem.FieldTooLong,
+			Message: fmt.Sprintf("Password can be at most %d bytes", maxPasswordLength)})
 	}
+	return fields
 }
@@ -2,97 +2,132 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
-	"log"
 	"net/http"
-	"strings"
+	"postSPA/problem"
+	"postSPA/storage"
 )
 
+// A user can subscribe to a category, to get its posts in their home
+// feed, or mute it, to keep its posts out of the post list.
+const (
+	PreferenceSubscribed = "subscribed"
+	PreferenceMuted      = "muted"
+)
+
+// Category is a category and how it is used. UserPreference is the
+// viewer's own PreferenceSubscribed or PreferenceMuted, or null.
 type Category struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	PostsCount       int     `json:"posts_count"`
+	SubscribersCount int     `json:"subscribers_count"`
+	UserPreference   *string `json:"user_preference"`
 }
 
 func ListCategoriesHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		rows, err := db.Query("SELECT id, name FROM categories ORDER BY name")
+		categories, err := listCategories(db, viewerID(db, r))
 		if err != nil {
-			http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+			writeInternalError(w, r, "error listing categories", err)
 			return
 		}
-		defer rows.Close()
-
-		var categories []Category
-		for rows.Next() {
-			var cat Category
-			if err := rows.Scan(&cat.ID, &cat.Name); err != nil {
-				http.Error(w, "Failed to read categories", http.StatusInternalServerError)
-				return
-			}
-			categories = append(categories, cat)
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(categories)
+		writeJSON(w, http.StatusOK, categories)
 	}
 }
 
-func GetCategoryPostsHandler(db *sql.DB) http.HandlerFunc {
+func GetCategoryPostsHandler(db *sql.DB, store storage.BlobStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		sort, window, ok := readSort(w, r)
+		if !ok {
 			return
 		}
-
-		categoryID := strings.TrimPrefix(r.URL.Path, "/api/categories/")
-		categoryID = strings.TrimSuffix(categoryID, "/posts")
-
-		rows, err := db.Query(`
-			SELECT p.id, p.user_id, u.username, p.content, p.image_path, p.created_at
-			FROM posts p
-			JOIN users u ON p.user_id = u.id
-			JOIN post_categories pc ON p.id = pc.post_id
-			WHERE pc.category_id = ?
-			ORDER BY p.created_at DESC
-			LIMIT 50`, categoryID)
+		q := postQuery{categoryID: r.PathValue("id"), sort: sort, window: window, viewerID: viewerID(db, r), limit: 50}
+		posts, _, err := listPosts(db, store, q)
 		if err != nil {
-			http.Error(w, "Failed to fetch category posts", http.StatusInternalServerError)
+			writeInternalError(w, r, "error listing category posts", err)
 			return
 		}
-		defer rows.Close()
-
-		var posts []Post
-		for rows.Next() {
-			var post Post
-			var imagePath sql.NullString
+		writeJSON(w, http.StatusOK, posts)
+	}
+}
 
-			err := rows.Scan(&post.ID, &post.UserID, &post.Username,
-				&post.Content, &imagePath, &post.CreatedAt)
-			if err != nil {
-				http.Error(w, "Failed to read posts", http.StatusInternalServerError)
-				return
-			}
+// listCategories returns every category by name, with UserPreference
+// set for viewerID. PostsCount counts the posts viewerID can see, as the
+// category's listing does.
+func listCategories(db *sql.DB, viewerID string) ([]Category, error) {
+	visiblePosts, args := visibleContent("p"), []any{viewerID}
+	if viewerID != "" {
+		visiblePosts += " AND " + visibleAuthor("p.user_id")
+		args = append(args, viewerID, viewerID)
+	}
+	rows, err := db.Query(`
+		SELECT c.id, c.name,
+			(SELECT COUNT(*) FROM post_categories pc JOIN posts p ON p.id = pc.post_id
+				WHERE pc.category_id = c.id AND `+visiblePosts+`),
+			(SELECT COUNT(*) FROM category_preferences
+				WHERE category_id = c.id AND preference = 'subscribed'),
+			(SELECT preference FROM category_preferences
+				WHERE category_id = c.id AND user_id = ?)
+		FROM categories c
+		ORDER BY c.name`, append(args, viewerID)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-			if imagePath.Valid {
-				post.ImagePath = &imagePath.String
-			}
+	categories := []Category{}
+	for rows.Next() {
+		var cat Category
+		var preference sql.NullString
+		if err := rows.Scan(&cat.ID, &cat.Name, &cat.PostsCount, &cat.SubscribersCount, &preference); err != nil {
+			return nil, err
+		}
+		if preference.Valid {
+			cat.UserPreference = &preference.String
+		}
+		categories = append(categories, cat)
+	}
+	return categories, rows.Err()
+}
 
-			categories, categErrs := GetPostCategories(db, post.ID)
-			if categErrs != nil {
-				log.Println("error getting categories from db in GetCategoryPostsHandler", categErrs)
-				http.Error(w, "An error occured, kindly check back later", http.StatusInternalServerError)
-			}
-			post.Categories = categories
+// setCategoryPreference makes preference the caller's setting for the
+// {id} category, replacing the other one, or clears it if set is false.
+// Clearing a preference the caller doesn't have changes nothing.
+func setCategoryPreference(w http.ResponseWriter, r *http.Request, db *sql.DB, preference string, set bool) bool {
+	userID, ok := requireUser(w, r, db)
+	if !ok {
+		return false
+	}
+	categoryID := r.PathValue("id")
 
-			posts = append(posts, post)
-		}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM categories WHERE id = ?)", categoryID).Scan(&exists)
+	if err != nil {
+		writeInternalError(w, r, "error loading category", err)
+		return false
+	}
+	if !exists {
+		writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Category not found")
+		return false
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(posts)
+	if set {
+		_, err = db.Exec(`
+			INSERT INTO category_preferences (user_id, category_id, preference)
+			VALUES (?, ?, ?)
+			ON CONFLICT (user_id, category_id)
+			DO UPDATE SET preference = excluded.preference, created_at = CURRENT_TIMESTAMP
+			WHERE preference != excluded.preference`,
+			userID, categoryID, preference)
+	} else {
+		_, err = db.Exec(`
+			DELETE FROM category_preferences
+			WHERE user_id = ? AND category_id = ? AND preference = ?`,
+			userID, categoryID, preference)
+	}
+	if err != nil {
+		writeInternalError(w, r, "error saving category preference", err)
+		return false
 	}
+	return true
 }
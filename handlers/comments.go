@@ -3,119 +3,248 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
 	"net/http"
+	"postSPA/problem"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Comment is a comment on a post. ModerationNotice is set when a
+// moderator hid the comment, or a content check held it for one, which
+// only its author still sees. ContentChecks is set on a new comment.
 type Comment struct {
-	ID        string    `json:"id"`
-	PostID    string    `json:"postId"`
-	UserID    string    `json:"userId"`
-	Username  string    `json:"username"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID               string                `json:"id"`
+	PostID           string                `json:"postId"`
+	UserID           string                `json:"userId"`
+	Username         string                `json:"username"`
+	Content          string                `json:"content"`
+	ModerationNotice *string               `json:"moderationNotice"`
+	ContentChecks    []problem.CheckResult `json:"contentChecks,omitempty"`
+	CreatedAt        time.Time             `json:"createdAt"`
 }
 
-func CreateCommentHandler(db *sql.DB) http.HandlerFunc {
+func CreateCommentHandler(db *sql.DB, checks ContentChecks) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, err := getAuthenticatedUserID(db, r)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		comment, ok := submitComment(w, r, db, checks)
+		if !ok {
 			return
 		}
 
-		postID := strings.TrimPrefix(r.URL.Path, "/api/posts/")
-		postID = strings.TrimSuffix(postID, "/comments")
-
-		var request struct {
-			Content string `json:"content"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+		// Return the post's new comment count
+		commentCount, err := GetPostCommentCount(db, comment.PostID)
+		if err != nil {
+			writeInternalError(w, r, "error counting comments", err)
 			return
 		}
 
-		request.Content = strings.TrimSpace(request.Content)
-		if len(request.Content) == 0 {
-			http.Error(w, "Comment cannot be empty", http.StatusBadRequest)
+		writeJSON(w, http.StatusCreated, commentCount)
+	}
+}
+
+func GetCommentsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewer := viewerID(db, r)
+		if !requireVisiblePost(w, r, db, viewer) {
 			return
 		}
-
-		commentID := uuid.New().String()
-		_, err = db.Exec(`
-			INSERT INTO comments (id, post_id, user_id, content)
-			VALUES (?, ?, ?, ?)`,
-			commentID, postID, userID, request.Content)
+		comments, _, err := listComments(db, r.PathValue("id"), viewer, -1, 0)
 		if err != nil {
-			http.Error(w, "Failed to create comment", http.StatusInternalServerError)
+			writeInternalError(w, r, "error listing comments", err)
 			return
 		}
+		writeJSON(w, http.StatusOK, comments)
+	}
+}
 
-		// Return the created comment
-		commentCount, commentCountErr := GetPostCommentCount(db, postID)
-		if commentCountErr != nil {
-			log.Fatalf("error in GetPostCommentCount: %v", commentCountErr)
-			http.Error(w, "An error occured try again later", http.StatusInternalServerError)
-			return
+// submitComment adds a comment to the post in the path and returns it.
+// The comment goes through checks first, and is held for a moderator if
+// one of them asks.
+func submitComment(w http.ResponseWriter, r *http.Request, db *sql.DB, checks ContentChecks) (Comment, bool) {
+	userID, ok := requireUser(w, r, db)
+	if !ok {
+		return Comment{}, false
+	}
+
+	postID := r.PathValue("id")
+	if !requireInteraction(w, r, db, userID) {
+		return Comment{}, false
+	}
+
+	var request struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeInvalidBody(w, r)
+		return Comment{}, false
+	}
+
+	request.Content = strings.TrimSpace(request.Content)
+	if len(request.Content) == 0 {
+		writeValidationError(w, r, problem.FieldError{Field: "content", Code: problem.FieldRequired,
+			Message: "Comment cannot be empty"})
+		return Comment{}, false
+	}
+	if len(request.Content) > maxContentLength {
+		writeValidationError(w, r, problem.FieldError{Field: "content", Code: problem.FieldTooLong,
+			Message: "Comment is too long"})
+		return Comment{}, false
+	}
+
+	review, ok := reviewContent(w, r, db, checks, Submission{UserID: userID, Kind: "comment", Text: request.Content})
+	if !ok {
+		return Comment{}, false
+	}
+
+	commentID := uuid.New().String()
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return Comment{}, false
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		INSERT INTO comments (id, post_id, user_id, content)
+		VALUES (?, ?, ?, ?)`,
+		commentID, postID, userID, review.text)
+	if err != nil {
+		writeInternalError(w, r, "error creating comment", err)
+		return Comment{}, false
+	}
+	if review.verdict == VerdictModerate {
+		if err := holdContent(tx, "comment", commentID, review.holdReason()); err != nil {
+			writeInternalError(w, r, "error holding comment", err)
+			return Comment{}, false
 		}
+		err := recordAudit(tx, r, auditEntry{actorID: userID, action: AuditContentHold, targetType: "comment", targetID: commentID,
+			details: map[string]any{"reason": review.holdReason()}})
+		if err != nil {
+			writeInternalError(w, r, "error recording audit event", err)
+			return Comment{}, false
+		}
+	}
+	if err := refreshPostScores(tx, postID); err != nil {
+		writeInternalError(w, r, "error updating post scores", err)
+		return Comment{}, false
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error creating comment", err)
+		return Comment{}, false
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(commentCount)
+	comment := Comment{ContentChecks: review.results}
+	err = db.QueryRow(`
+		SELECT c.id, c.post_id, c.user_id, u.username, c.content, c.created_at
+		FROM comments c
+		JOIN users u ON c.user_id = u.id
+		WHERE c.id = ?`, commentID).
+		Scan(&comment.ID, &comment.PostID, &comment.UserID,
+			&comment.Username, &comment.Content, &comment.CreatedAt)
+	if err != nil {
+		writeInternalError(w, r, "error fetching created comment", err)
+		return Comment{}, false
+	}
+	if review.verdict == VerdictModerate {
+		notice := heldCommentNotice
+		comment.ModerationNotice = &notice
 	}
+	return comment, true
 }
 
-func GetCommentsHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+// listComments returns a page of a post's comments, newest first, and
+// how many of them viewerID can see. A negative limit returns them all.
+func listComments(db *sql.DB, postID, viewerID string, limit, offset int) ([]Comment, int, error) {
+	where, args := visibleComments("c.post_id = ?", []any{postID}, viewerID)
+	total, err := countComments(db, where, args)
+	if err != nil {
+		return nil, 0, err
+	}
+	comments, err := queryComments(db, where, args, limit, offset)
+	return comments, total, err
+}
 
-		postID := strings.TrimPrefix(r.URL.Path, "/api/posts/")
-		postID = strings.TrimSuffix(postID, "/comments")
+// listUserComments returns a page of a user's comments, newest first,
+// and how many of them viewerID can see. Comments on posts viewerID
+// can't see are left out too.
+func listUserComments(db *sql.DB, userID, viewerID string, limit, offset int) ([]Comment, int, error) {
+	where, args := visibleComments("c.user_id = ? AND "+visibleContent("p"), []any{userID, viewerID}, viewerID)
+	if viewerID != "" {
+		where += " AND " + visibleAuthor("p.user_id")
+		args = append(args, viewerID, viewerID)
+	}
+	total, err := countComments(db, where, args)
+	if err != nil {
+		return nil, 0, err
+	}
+	comments, err := queryComments(db, where, args, limit, offset)
+	return comments, total, err
+}
+
+// visibleComments narrows where to the comments viewerID may see:
+// not moderated, unless hidden and their own, and not by a user
+// restricted either way.
+func visibleComments(where string, args []any, viewerID string) (string, []any) {
+	where += " AND " + visibleContent("c")
+	args = append(args, viewerID)
+	if viewerID == "" {
+		return where, args
+	}
+	return where + " AND " + visibleAuthor("c.user_id"), append(args, viewerID, viewerID)
+}
 
-		rows, err := db.Query(`
-			SELECT c.id, c.post_id, c.user_id, u.username, c.content, c.created_at
-			FROM comments c
-			JOIN users u ON c.user_id = u.id
-			WHERE c.post_id = ?
-			ORDER BY c.created_at DESC`, postID)
+func countComments(db *sql.DB, where string, args []any) (int, error) {
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM comments c JOIN posts p ON p.id = c.post_id WHERE "+where, args...).Scan(&total)
+	return total, err
+}
+
+// queryComments pages through the comments matching where, a condition
+// on comments c and their posts p.
+func queryComments(db *sql.DB, where string, args []any, limit, offset int) ([]Comment, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.post_id, c.user_id, u.username, c.content, c.moderation, c.created_at,
+			EXISTS (SELECT 1 FROM content_holds h WHERE h.target_type = 'comment' AND h.target_id = c.id)
+		FROM comments c
+		JOIN posts p ON p.id = c.post_id
+		JOIN users u ON c.user_id = u.id
+		WHERE `+where+`
+		ORDER BY c.created_at DESC
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		var comment Comment
+		var moderation sql.NullString
+		var held bool
+		err := rows.Scan(&comment.ID, &comment.PostID, &comment.UserID,
+			&comment.Username, &comment.Content, &moderation, &comment.CreatedAt, &held)
 		if err != nil {
-			http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		defer rows.Close()
-
-		comments := []Comment{}
-		for rows.Next() {
-			var comment Comment
-			err := rows.Scan(&comment.ID, &comment.PostID, &comment.UserID,
-				&comment.Username, &comment.Content, &comment.CreatedAt)
-			if err != nil {
-				http.Error(w, "Failed to read comments", http.StatusInternalServerError)
-				return
+		if moderation.String == "hidden" {
+			notice := hiddenCommentNotice
+			if held {
+				notice = heldCommentNotice
 			}
-			comments = append(comments, comment)
+			comment.ModerationNotice = &notice
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(comments)
+		comments = append(comments, comment)
 	}
+	return comments, rows.Err()
 }
 
 func GetPostCommentCount(db *sql.DB, postID string) (int, error) {
 	commentCount := 0
-	err := db.QueryRow(`
-			SELECT COUNT(*) as comment_count
-			FROM comments
-			WHERE post_id = ?`, postID).
+	err := db.QueryRow("SELECT comments_count FROM posts WHERE id = ?", postID).
 		Scan(&commentCount)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
 		return 0, err
 	}
 	return commentCount, nil
@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"postSPA/config"
+	"postSPA/problem"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Content check verdicts, from least to most severe. A submission gets
+// the most severe verdict of all its checks.
+const (
+	VerdictAllow    = "allow"
+	VerdictMask     = "mask"
+	VerdictModerate = "moderate"
+	VerdictBlock    = "block"
+)
+
+var verdictSeverity = map[string]int{VerdictAllow: 0, VerdictMask: 1, VerdictModerate: 2, VerdictBlock: 3}
+
+// Submission is a post or comment about to be saved. Checks may rewrite
+// Text.
+type Submission struct {
+	UserID  string
+	Kind    string // "post" or "comment"
+	Text    string
+	Editing bool // an edit of existing content, which some checks skip
+}
+
+// ContentCheck is one step of the content pipeline. It returns a
+// Verdict constant and, unless it allows the submission, why.
+type ContentCheck interface {
+	Name() string
+	Check(db *sql.DB, s *Submission) (verdict, reason string, err error)
+}
+
+// ContentChecks is the pipeline every new post and comment goes
+// through before it is saved. Each check sees the text as the checks
+// before it left it.
+type ContentChecks []ContentCheck
+
+// NewContentChecks builds the checks cfg turns on.
+func NewContentChecks(cfg config.Content) ContentChecks {
+	var checks ContentChecks
+	if len(cfg.BannedWords) > 0 {
+		checks = append(checks, newBannedWords(cfg.BannedWords))
+	}
+	if cfg.MaxLinks > 0 {
+		checks = append(checks, linkLimit{max: cfg.MaxLinks})
+	}
+	if cfg.DuplicateWindow > 0 {
+		checks = append(checks, duplicates{window: cfg.DuplicateWindow})
+	}
+	if cfg.NewAccountAge > 0 && cfg.NewAccountLimit > 0 {
+		checks = append(checks, newAccountLimit{age: cfg.NewAccountAge, limit: cfg.NewAccountLimit, window: cfg.NewAccountWindow})
+	}
+	return checks
+}
+
+// contentReview is what the pipeline made of a submission.
+type contentReview struct {
+	verdict string
+	text    string // after masking
+	results []problem.CheckResult
+}
+
+func (cc ContentChecks) review(db *sql.DB, s Submission) (contentReview, error) {
+	review := contentReview{verdict: VerdictAllow, results: []problem.CheckResult{}}
+	for _, c := range cc {
+		verdict, reason, err := c.Check(db, &s)
+		if err != nil {
+			return contentReview{}, fmt.Errorf("%s check failed: %w", c.Name(), err)
+		}
+		review.results = append(review.results, problem.CheckResult{Check: c.Name(), Verdict: verdict, Reason: reason})
+		if verdictSeverity[verdict] > verdictSeverity[review.verdict] {
+			review.verdict = verdict
+		}
+	}
+	review.text = s.Text
+	return review, nil
+}
+
+// holdReason explains to moderators why the content is waiting for them.
+func (cr contentReview) holdReason() string {
+	var reasons []string
+	for _, res := range cr.results {
+		if res.Verdict == VerdictModerate {
+			reasons = append(reasons, res.Reason)
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// reviewContent runs checks on s, or writes a 422 listing every check's
+// verdict if one of them blocks it.
+func reviewContent(w http.ResponseWriter, r *http.Request, db *sql.DB, checks ContentChecks, s Submission) (contentReview, bool) {
+	review, err := checks.review(db, s)
+	if err != nil {
+		writeInternalError(w, r, "error checking content", err)
+		return contentReview{}, false
+	}
+	if review.verdict == VerdictBlock {
+		var reasons []string
+		for _, res := range review.results {
+			if res.Verdict == VerdictBlock {
+				reasons = append(reasons, res.Reason)
+			}
+		}
+		p := problem.New(http.StatusUnprocessableEntity, problem.CodeContentRejected, strings.Join(reasons, "; "))
+		p.Checks = review.results
+		problem.Write(w, r, p)
+		return contentReview{}, false
+	}
+	return review, true
+}
+
+// bannedWords matches the configured words, one pattern per mode.
+type bannedWords struct {
+	patterns map[string]*regexp.Regexp
+}
+
+// A banned word must not be part of a longer word. \b would judge that
+// by ASCII letters only, so the boundaries are spelled out in Unicode
+// and the word itself is the first group.
+const (
+	wordStart = `(?:^|[^\p{L}\p{N}_])`
+	wordEnd   = `(?:$|[^\p{L}\p{N}_])`
+)
+
+func newBannedWords(words []config.BannedWord) bannedWords {
+	byMode := map[string][]string{}
+	for _, bw := range words {
+		byMode[bw.Mode] = append(byMode[bw.Mode], regexp.QuoteMeta(strings.TrimSpace(bw.Word)))
+	}
+	b := bannedWords{patterns: map[string]*regexp.Regexp{}}
+	for mode, quoted := range byMode {
+		b.patterns[mode] = regexp.MustCompile(`(?i)` + wordStart + `(` + strings.Join(quoted, "|") + `)` + wordEnd)
+	}
+	return b
+}
+
+// find returns the words mode's pattern matches in text, with their
+// positions.
+func (b bannedWords) find(mode, text string) [][]int {
+	re := b.patterns[mode]
+	if re == nil {
+		return nil
+	}
+	// The boundary characters are part of each match, so words separated
+	// by a single character need a second look from the end of the word
+	var found [][]int
+	for start := 0; start < len(text); {
+		loc := re.FindStringSubmatchIndex(text[start:])
+		if loc == nil {
+			break
+		}
+		found = append(found, []int{start + loc[2], start + loc[3]})
+		start += loc[3]
+	}
+	return found
+}
+
+func (bannedWords) Name() string { return "banned_words" }
+
+// Check blocks the submission if it has a word that blocks. Otherwise
+// it masks the words that mask and holds the submission for words that
+// need a moderator, reporting both.
+func (b bannedWords) Check(_ *sql.DB, s *Submission) (string, string, error) {
+	if found := b.find(VerdictBlock, s.Text); len(found) > 0 {
+		return VerdictBlock, "Contains words that aren't allowed: " + listWords(s.Text, found), nil
+	}
+
+	verdict := VerdictAllow
+	var reasons []string
+	if found := b.find(VerdictModerate, s.Text); len(found) > 0 {
+		verdict = VerdictModerate
+		reasons = append(reasons, "Contains words a moderator has to approve: "+listWords(s.Text, found))
+	}
+	if found := b.find(VerdictMask, s.Text); len(found) > 0 {
+		if verdict == VerdictAllow {
+			verdict = VerdictMask
+		}
+		reasons = append(reasons, "Masked words that aren't allowed: "+listWords(s.Text, found))
+		var masked strings.Builder
+		last := 0
+		for _, loc := range found {
+			masked.WriteString(s.Text[last:loc[0]])
+			masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(s.Text[loc[0]:loc[1]])))
+			last = loc[1]
+		}
+		masked.WriteString(s.Text[last:])
+		s.Text = masked.String()
+	}
+	return verdict, strings.Join(reasons, "; "), nil
+}
+
+// listWords joins the distinct words of text at found, ignoring case.
+func listWords(text string, found [][]int) string {
+	seen := map[string]bool{}
+	var words []string
+	for _, loc := range found {
+		if lower := strings.ToLower(text[loc[0]:loc[1]]); !seen[lower] {
+			seen[lower] = true
+			words = append(words, lower)
+		}
+	}
+	return strings.Join(words, ", ")
+}
+
+// linkLimit caps the number of links, bare or in Markdown.
+type linkLimit struct {
+	max int
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+func (linkLimit) Name() string { return "links" }
+
+func (l linkLimit) Check(_ *sql.DB, s *Submission) (string, string, error) {
+	if n := len(linkPattern.FindAllStringIndex(s.Text, -1)); n > l.max {
+		return VerdictBlock, fmt.Sprintf("Contains %d links; at most %d are allowed", n, l.max), nil
+	}
+	return VerdictAllow, "", nil
+}
+
+// duplicates refuses new content identical, ignoring case and spacing,
+// to a post or comment (whichever is being submitted) the same user
+// wrote within window.
+type duplicates struct {
+	window time.Duration
+}
+
+func (duplicates) Name() string { return "duplicate" }
+
+func (d duplicates) Check(db *sql.DB, s *Submission) (string, string, error) {
+	text := normalizeContent(s.Text)
+	if s.Editing || text == "" {
+		return VerdictAllow, "", nil
+	}
+
+	table := "posts"
+	if s.Kind == "comment" {
+		table = "comments"
+	}
+	rows, err := db.Query("SELECT content FROM "+table+" WHERE user_id = ? AND created_at > datetime('now', ?)",
+		s.UserID, sqliteAgo(d.window))
+	if err != nil {
+		return "", "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			return "", "", err
+		}
+		if normalizeContent(content) == text {
+			return VerdictBlock, fmt.Sprintf("You already posted this in the last %s", shortDuration(d.window)), nil
+		}
+	}
+	return VerdictAllow, "", rows.Err()
+}
+
+func normalizeContent(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// newAccountLimit rate limits posts and comments together from
+// accounts younger than age.
+type newAccountLimit struct {
+	age    time.Duration
+	limit  int
+	window time.Duration
+}
+
+func (newAccountLimit) Name() string { return "new_account_rate" }
+
+func (n newAccountLimit) Check(db *sql.DB, s *Submission) (string, string, error) {
+	if s.Editing {
+		return VerdictAllow, "", nil
+	}
+	var createdAt time.Time
+	if err := db.QueryRow("SELECT created_at FROM users WHERE id = ?", s.UserID).Scan(&createdAt); err != nil {
+		return "", "", err
+	}
+	if time.Since(createdAt) >= n.age {
+		return VerdictAllow, "", nil
+	}
+
+	var recent int
+	since := sqliteAgo(n.window)
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM posts WHERE user_id = ? AND created_at > datetime('now', ?))
+			+ (SELECT COUNT(*) FROM comments WHERE user_id = ? AND created_at > datetime('now', ?))`,
+		s.UserID, since, s.UserID, since).Scan(&recent)
+	if err != nil {
+		return "", "", err
+	}
+	if recent >= n.limit {
+		return VerdictBlock, fmt.Sprintf("New accounts can post %d times per %s; try again later",
+			n.limit, shortDuration(n.window)), nil
+	}
+	return VerdictAllow, "", nil
+}
+
+// sqliteAgo is a datetime('now', ?) modifier for d ago.
+func sqliteAgo(d time.Duration) string {
+	return fmt.Sprintf("-%d seconds", int64(d.Seconds()))
+}
+
+// shortDuration formats d without zero units: 1h rather than 1h0m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
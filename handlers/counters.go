@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// RecountReport lists the rows whose stored counters did not match the
+// rows they count.
+type RecountReport struct {
+	DryRun   bool
+	Posts    []string // IDs of posts whose counts were wrong
+	Comments []string // IDs of comments whose counts were wrong
+}
+
+// counter is a denormalized column and the query that computes its true
+// value for the row aliased t.
+type counter struct {
+	column string
+	count  string
+}
+
+var postCounters = []counter{
+	{"likes_count", "SELECT COUNT(*) FROM reactions WHERE post_id = t.id AND type = 'like'"},
+	{"dislikes_count", "SELECT COUNT(*) FROM reactions WHERE post_id = t.id AND type = 'dislike'"},
+	{"comments_count", "SELECT COUNT(*) FROM comments WHERE post_id = t.id AND moderation IS NULL"},
+}
+
+var commentCounters = []counter{
+	{"likes_count", "SELECT COUNT(*) FROM reactions WHERE comment_id = t.id AND type = 'like'"},
+	{"dislikes_count", "SELECT COUNT(*) FROM reactions WHERE comment_id = t.id AND type = 'dislike'"},
+}
+
+// Recount compares the denormalized likes, dislikes and comments counts
+// with the reactions and comments tables and repairs any that drifted,
+// along with the ranking scores of the affected posts. With dryRun it
+// only reports.
+func Recount(db *sql.DB, dryRun bool) (RecountReport, error) {
+	report := RecountReport{DryRun: dryRun}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	report.Posts, err = recountTable(tx, "posts", postCounters, dryRun)
+	if err != nil {
+		return report, err
+	}
+	report.Comments, err = recountTable(tx, "comments", commentCounters, dryRun)
+	if err != nil {
+		return report, err
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	for _, id := range report.Posts {
+		if err := refreshPostScores(tx, id); err != nil {
+			return report, err
+		}
+	}
+	return report, tx.Commit()
+}
+
+// recountTable returns the IDs of the rows in table where any counter
+// is wrong, and corrects them unless dryRun.
+func recountTable(tx *sql.Tx, table string, counters []counter, dryRun bool) ([]string, error) {
+	var drift, assign []string
+	for _, c := range counters {
+		drift = append(drift, fmt.Sprintf("t.%s != (%s)", c.column, c.count))
+		assign = append(assign, fmt.Sprintf("%s = (%s)", c.column, c.count))
+	}
+
+	rows, err := tx.Query("SELECT t.id FROM " + table + " t WHERE " + strings.Join(drift, " OR "))
+	if err != nil {
+		return nil, fmt.Errorf("cannot check %s counters: %w", table, err)
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return ids, nil
+	}
+	for _, id := range ids {
+		_, err := tx.Exec("UPDATE "+table+" AS t SET "+strings.Join(assign, ", ")+" WHERE t.id = ?", id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot repair %s counters: %w", table, err)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Follow is the other user in a follow, as listed on someone's
+// followers or following page.
+type Follow struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+// follow is idempotent: following someone again keeps the original date.
+func follow(db *sql.DB, followerID, followeeID string) error {
+	_, err := db.Exec(`
+		INSERT INTO follows (follower_id, followee_id) VALUES (?, ?)
+		ON CONFLICT DO NOTHING`, followerID, followeeID)
+	return err
+}
+
+func unfollow(db *sql.DB, followerID, followeeID string) error {
+	_, err := db.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?",
+		followerID, followeeID)
+	return err
+}
+
+// listFollowers returns the users following userID, most recent first,
+// and how many there are in total.
+func listFollowers(db *sql.DB, userID string, limit, offset int) ([]Follow, int, error) {
+	return queryFollows(db, "followee_id", "follower_id", userID, limit, offset)
+}
+
+// listFollowing returns the users userID follows, most recent first,
+// and how many there are in total.
+func listFollowing(db *sql.DB, userID string, limit, offset int) ([]Follow, int, error) {
+	return queryFollows(db, "follower_id", "followee_id", userID, limit, offset)
+}
+
+// queryFollows lists the other side of the follows whose column is
+// userID. Both columns are fixed names, never user input.
+func queryFollows(db *sql.DB, column, other, userID string, limit, offset int) ([]Follow, int, error) {
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM follows WHERE "+column+" = ?", userID).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot count follows: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, u.username, f.created_at
+		FROM follows f
+		JOIN users u ON u.id = f.`+other+`
+		WHERE f.`+column+` = ?
+		ORDER BY f.created_at DESC, u.id DESC
+		LIMIT ? OFFSET ?`, userID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list follows: %w", err)
+	}
+	defer rows.Close()
+
+	follows := []Follow{}
+	for rows.Next() {
+		var f Follow
+		if err := rows.Scan(&f.ID, &f.Username, &f.FollowedAt); err != nil {
+			return nil, 0, fmt.Errorf("cannot read follow row: %w", err)
+		}
+		follows = append(follows, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot list follows: %w", err)
+	}
+	return follows, total, nil
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"postSPA/storage"
+	"time"
+)
+
+// staleUpload matches uploads no post uses any more whose last use is
+// older than the grace period (the single parameter).
+const staleUpload = "ref_count <= 0 AND last_used_at < ?"
+
+// GCReport summarises one garbage collection run.
+type GCReport struct {
+	DryRun     bool
+	Scanned    int
+	Kept       int
+	Removed    []string // blob keys deleted, or that would be in a dry run
+	FreedBytes int64
+}
+
+// CollectUploads deletes blobs that no post references. Blobs younger
+// than grace are kept even if unreferenced, since they may belong to a
+// post that is still being created. With dryRun nothing is changed and
+// the report lists what would be removed.
+func CollectUploads(ctx context.Context, db *sql.DB, store storage.BlobStore, grace time.Duration, dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun}
+
+	lister, ok := store.(storage.Lister)
+	if !ok {
+		return report, errors.New("upload store cannot list its blobs")
+	}
+
+	cutoff := time.Now().UTC().Add(-grace)
+	dbCutoff := cutoff.Format("2006-01-02 15:04:05")
+
+	// Forget stale uploads first, so a new post can no longer reuse
+	// their files while they are being deleted
+	if !dryRun {
+		if err := forgetStaleUploads(db, dbCutoff); err != nil {
+			return report, err
+		}
+	}
+
+	referenced, err := referencedBlobs(db, dbCutoff)
+	if err != nil {
+		return report, err
+	}
+
+	blobs, err := lister.List(ctx)
+	if err != nil {
+		return report, fmt.Errorf("cannot list uploads: %w", err)
+	}
+
+	for _, blob := range blobs {
+		report.Scanned++
+		if referenced[blob.Key] || blob.ModTime.After(cutoff) {
+			report.Kept++
+			continue
+		}
+
+		if !dryRun {
+			err := store.Delete(ctx, blob.Key)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return report, fmt.Errorf("cannot delete %s: %w", blob.Key, err)
+			}
+		}
+		report.Removed = append(report.Removed, blob.Key)
+		report.FreedBytes += blob.Size
+	}
+
+	return report, nil
+}
+
+func forgetStaleUploads(db *sql.DB, cutoff string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM image_variants
+		WHERE image_path IN (SELECT image_path FROM uploads WHERE `+staleUpload+`)`, cutoff)
+	if err != nil {
+		return fmt.Errorf("cannot remove stale variants: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM uploads WHERE "+staleUpload, cutoff)
+	if err != nil {
+		return fmt.Errorf("cannot remove stale uploads: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// referencedBlobs returns every blob key still in use. Variants without
+// an uploads row and legacy posts.image_path values count as in use.
+func referencedBlobs(db *sql.DB, cutoff string) (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT iv.file_name
+		FROM image_variants iv
+		LEFT JOIN uploads u ON u.image_path = iv.image_path
+		WHERE u.image_path IS NULL OR NOT (`+staleUpload+`)
+		UNION
+		SELECT image_path FROM uploads WHERE NOT (`+staleUpload+`)
+		UNION
+		SELECT image_path FROM posts WHERE image_path IS NOT NULL`,
+		cutoff, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load referenced uploads: %w", err)
+	}
+	defer rows.Close()
+
+	referenced := map[string]bool{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		referenced[key] = true
+	}
+	return referenced, rows.Err()
+}
+
+// RunUploadGC collects unreferenced uploads every interval until ctx is
+// cancelled.
+func RunUploadGC(ctx context.Context, db *sql.DB, store storage.BlobStore, interval, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := CollectUploads(ctx, db, store, grace, false)
+			if err != nil {
+				slog.ErrorContext(ctx, "upload GC failed", "err", err)
+				continue
+			}
+			if len(report.Removed) > 0 {
+				slog.InfoContext(ctx, "upload GC removed files", "removed", len(report.Removed),
+					"scanned", report.Scanned, "freed_bytes", report.FreedBytes)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"postSPA/problem"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How a moderator resolves a hold.
+const (
+	HoldApprove = "approve"
+	HoldRemove  = "remove"
+)
+
+// Shown to the author of held content, the only one who sees it until a
+// moderator approves it
+const (
+	heldPostNotice    = "This post is waiting for a moderator. Only you can see it."
+	heldCommentNotice = "This comment is waiting for a moderator. Only you can see it."
+)
+
+// Hold is a post or comment a content check sent to moderators, with
+// the check's reason.
+type Hold struct {
+	ID         string    `json:"id"`
+	TargetType string    `json:"target_type"`
+	TargetID   string    `json:"target_id"`
+	UserID     string    `json:"user_id"`
+	Username   string    `json:"username"`
+	Content    string    `json:"content"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// holdContent hides a post or comment until a moderator has looked at
+// it. Holding content that is already held replaces the reason; content
+// a moderator already hid stays as they left it, without a hold that
+// approving would undo.
+func holdContent(q querier, targetType, targetID, reason string) error {
+	res, err := q.Exec("UPDATE "+moderatedTables[targetType]+" SET moderation = 'hidden' WHERE id = ? AND moderation IS NULL",
+		targetID)
+	if err != nil {
+		return fmt.Errorf("cannot hide held %s: %w", targetType, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		_, err = q.Exec("UPDATE content_holds SET reason = ? WHERE target_type = ? AND target_id = ?",
+			reason, targetType, targetID)
+		return err
+	}
+	_, err = q.Exec("INSERT INTO content_holds (id, target_type, target_id, reason) VALUES (?, ?, ?, ?)",
+		uuid.New().String(), targetType, targetID, reason)
+	if err != nil {
+		return fmt.Errorf("cannot hold %s: %w", targetType, err)
+	}
+	return nil
+}
+
+const holdColumns = `h.id, h.target_type, h.target_id, h.reason, h.created_at,
+	COALESCE(p.user_id, c.user_id, ''), COALESCE(u.username, ''), COALESCE(p.content, c.content, '')`
+
+const holdFrom = `
+	FROM content_holds h
+	LEFT JOIN posts p ON h.target_type = 'post' AND p.id = h.target_id
+	LEFT JOIN comments c ON h.target_type = 'comment' AND c.id = h.target_id
+	LEFT JOIN users u ON u.id = COALESCE(p.user_id, c.user_id)`
+
+func scanHold(row rowScanner) (Hold, error) {
+	var h Hold
+	err := row.Scan(&h.ID, &h.TargetType, &h.TargetID, &h.Reason, &h.CreatedAt, &h.UserID, &h.Username, &h.Content)
+	return h, err
+}
+
+// listHolds returns a page of held content, oldest first so the queue
+// is worked in order, and how much there is.
+func listHolds(db *sql.DB, limit, offset int) ([]Hold, int, error) {
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM content_holds").Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("cannot count holds: %w", err)
+	}
+
+	rows, err := db.Query("SELECT "+holdColumns+holdFrom+`
+		ORDER BY h.created_at, h.id
+		LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list holds: %w", err)
+	}
+	defer rows.Close()
+
+	holds := []Hold{}
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot read hold row: %w", err)
+		}
+		holds = append(holds, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot list holds: %w", err)
+	}
+	return holds, total, nil
+}
+
+// resolveHold approves or removes the held content in the path, which
+// ends the hold.
+func resolveHold(w http.ResponseWriter, r *http.Request, db *sql.DB) bool {
+	moderatorID, ok := requireModerator(w, r, db)
+	if !ok {
+		return false
+	}
+
+	var req struct {
+		Action string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeInvalidBody(w, r)
+		return false
+	}
+	if req.Action != HoldApprove && req.Action != HoldRemove {
+		writeValidationError(w, r, problem.FieldError{Field: "action", Code: problem.FieldInvalid,
+			Message: "action must be approve or remove"})
+		return false
+	}
+
+	h, err := scanHold(db.QueryRow("SELECT "+holdColumns+holdFrom+" WHERE h.id = ?", r.PathValue("id")))
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Hold not found")
+		return false
+	} else if err != nil {
+		writeInternalError(w, r, "error loading hold", err)
+		return false
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return false
+	}
+	defer tx.Rollback()
+
+	table := moderatedTables[h.TargetType]
+	action := AuditContentApprove
+	if req.Action == HoldApprove {
+		_, err = tx.Exec("UPDATE "+table+" SET moderation = NULL WHERE id = ? AND moderation = 'hidden'", h.TargetID)
+	} else {
+		action = AuditContentRemove
+		_, err = tx.Exec("UPDATE "+table+" SET moderation = 'removed' WHERE id = ?", h.TargetID)
+	}
+	if err != nil {
+		writeInternalError(w, r, "error applying moderation action", err)
+		return false
+	}
+	if _, err := tx.Exec("DELETE FROM content_holds WHERE id = ?", h.ID); err != nil {
+		writeInternalError(w, r, "error resolving hold", err)
+		return false
+	}
+	if h.TargetType == "comment" {
+		if err := refreshCommentPostScores(tx, h.TargetID); err != nil {
+			writeInternalError(w, r, "error updating post scores", err)
+			return false
+		}
+	}
+	err = recordAudit(tx, r, auditEntry{actorID: moderatorID, action: action, targetType: h.TargetType, targetID: h.TargetID,
+		details: map[string]any{"hold_reason": h.Reason}})
+	if err != nil {
+		writeInternalError(w, r, "error recording audit event", err)
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error resolving hold", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"postSPA/config"
+	"postSPA/storage"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	VariantOriginal  = "original"
+	VariantMedium    = "medium"
+	VariantThumbnail = "thumbnail"
+)
+
+type ImageVariant struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// encoding describes how variants of an upload are written.
+type encoding struct {
+	ext         string
+	contentType string
+	encode      func(io.Writer, image.Image) error
+}
+
+var (
+	jpegEncoding = encoding{".jpg", "image/jpeg", func(w io.Writer, m image.Image) error {
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: 85})
+	}}
+	pngEncoding = encoding{".png", "image/png", func(w io.Writer, m image.Image) error {
+		return png.Encode(w, m)
+	}}
+)
+
+// storedVariant is a file written to the blob store.
+type storedVariant struct {
+	Name     string
+	FileName string
+	Width    int
+	Height   int
+}
+
+// processUpload decodes an uploaded image and writes a re-encoded
+// original plus resized variants to the blob store, naming each file
+// after base. Variants are sized per limits; images already smaller
+// than a variant's size are not upscaled. Re-encoding drops any metadata the client sent (EXIF,
+// GPS, comments); JPEG orientation is applied to the pixels first so
+// photos stay upright. The returned slice always starts with the
+// original.
+func processUpload(ctx context.Context, store storage.BlobStore, limits config.Uploads, data []byte, filetype, base string) ([]storedVariant, error) {
+	// Check the header before decoding so a tiny file claiming huge
+	// dimensions can't exhaust memory
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > limits.MaxImagePixels {
+		return nil, fmt.Errorf("image dimensions %dx%d not allowed", cfg.Width, cfg.Height)
+	}
+
+	// Every variant, including the original, is decoded in full and
+	// re-encoded, so the stored bytes never come from the client and
+	// files that are both an image and something else are neutralised
+	if filetype == "image/gif" {
+		return processGIF(ctx, store, limits, data, base)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	enc := pngEncoding
+	if filetype == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+		enc = jpegEncoding
+	}
+
+	original, err := writeVariant(ctx, store, VariantOriginal, base+enc.ext, img, enc)
+	if err != nil {
+		return nil, err
+	}
+	return addResizedVariants(ctx, store, limits, original, img, base, enc)
+}
+
+// processGIF keeps animation intact for the original and uses the first
+// frame for the resized variants, which are stored as PNG.
+func processGIF(ctx context.Context, store storage.BlobStore, limits config.Uploads, data []byte, base string) ([]storedVariant, error) {
+	// DecodeAll allocates every frame, so a small file with thousands of
+	// frames could exhaust memory; the limit covers all of them together
+	pixels, err := gifPixels(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+	if pixels > limits.MaxImagePixels {
+		return nil, fmt.Errorf("animation with %d pixels over all frames not allowed", pixels)
+	}
+
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	// EncodeAll writes only frames and the loop count, so comment and
+	// application extensions from the upload are dropped
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return nil, err
+	}
+	fileName := base + ".gif"
+	if err := store.Put(ctx, fileName, &buf, int64(buf.Len()), "image/gif"); err != nil {
+		return nil, err
+	}
+	original := storedVariant{VariantOriginal, fileName, anim.Config.Width, anim.Config.Height}
+
+	first := image.NewRGBA(image.Rect(0, 0, anim.Config.Width, anim.Config.Height))
+	draw.Draw(first, first.Bounds(), anim.Image[0], image.Point{}, draw.Over)
+
+	return addResizedVariants(ctx, store, limits, original, first, base, pngEncoding)
+}
+
+// gifPixels adds up the width*height of every frame of a GIF by walking
+// its blocks, without decompressing any of them.
+func gifPixels(data []byte) (int, error) {
+	errTruncated := fmt.Errorf("truncated GIF")
+	if len(data) < 13 {
+		return 0, errTruncated
+	}
+	i := 13
+	// Global color table
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+
+	// skipSubBlocks moves i past a chain of data sub-blocks
+	skipSubBlocks := func() error {
+		for {
+			if i >= len(data) {
+				return errTruncated
+			}
+			n := int(data[i])
+			i += 1 + n
+			if n == 0 {
+				return nil
+			}
+		}
+	}
+
+	pixels := 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension: label, then sub-blocks
+			i += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor
+			if i+10 > len(data) {
+				return 0, errTruncated
+			}
+			w := int(binary.LittleEndian.Uint16(data[i+5:]))
+			h := int(binary.LittleEndian.Uint16(data[i+7:]))
+			pixels += w * h
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++ // LZW minimum code size
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x3B: // trailer
+			return pixels, nil
+		default:
+			return 0, fmt.Errorf("unexpected GIF block 0x%02x", data[i])
+		}
+	}
+	return pixels, nil
+}
+
+// addResizedVariants writes the medium and thumbnail variants of img and
+// returns them after the original. Files already written when an error
+// occurs are left for gc-uploads, since another post may share them.
+func addResizedVariants(ctx context.Context, store storage.BlobStore, limits config.Uploads, original storedVariant, img image.Image, base string, enc encoding) ([]storedVariant, error) {
+	variants := []storedVariant{original}
+
+	for _, v := range []struct {
+		name string
+		size int
+	}{{VariantMedium, limits.MediumSize}, {VariantThumbnail, limits.ThumbnailSize}} {
+		resized, ok := resize(img, v.size)
+		if !ok {
+			// Already small enough, point the variant at the original
+			variants = append(variants, storedVariant{v.name, original.FileName, original.Width, original.Height})
+			continue
+		}
+		stored, err := writeVariant(ctx, store, v.name, base+"_"+v.name+enc.ext, resized, enc)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, stored)
+	}
+
+	return variants, nil
+}
+
+func writeVariant(ctx context.Context, store storage.BlobStore, name, fileName string, img image.Image, enc encoding) (storedVariant, error) {
+	var buf bytes.Buffer
+	if err := enc.encode(&buf, img); err != nil {
+		return storedVariant{}, err
+	}
+	if err := store.Put(ctx, fileName, &buf, int64(buf.Len()), enc.contentType); err != nil {
+		return storedVariant{}, err
+	}
+
+	b := img.Bounds()
+	return storedVariant{name, fileName, b.Dx(), b.Dy()}, nil
+}
+
+// resize scales img so its longest edge is size pixels. It reports false
+// if the image already fits.
+func resize(img image.Image, size int) (image.Image, bool) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img, false
+	}
+
+	if w >= h {
+		h = max(1, h*size/w)
+		w = size
+	} else {
+		w = max(1, w*size/h)
+		h = size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst, true
+}
+
+// jpegOrientation reads the EXIF orientation tag (1-8) from a JPEG. It
+// returns 1 (upright) when there is no EXIF data or it cannot be parsed.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan / end of image, no more metadata
+			return 1
+		}
+		segLen := int(binary.BigEndian.Uint16(data[i+2:]))
+		if segLen < 2 || i+2+segLen > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+segLen]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + segLen
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		off := ifd + 2 + e*12
+		if off+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[off:]) == 0x0112 {
+			v := int(order.Uint16(tiff[off+8:]))
+			if v < 1 || v > 8 {
+				return 1
+			}
+			return v
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates/flips img so that it displays upright once
+// the EXIF orientation tag has been stripped.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	// Move 4-byte pixels between Pix slices rather than going through
+	// At and Set, which take seconds on a large photo. JPEGs decode to
+	// YCbCr, so anything but RGBA and NRGBA is converted once first
+	var src, dstPix []byte
+	var srcStride, dstStride int
+	var dst image.Image
+	if m, ok := img.(*image.NRGBA); ok {
+		src, srcStride = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride
+		d := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+		dst, dstPix, dstStride = d, d.Pix, d.Stride
+	} else {
+		m, ok := img.(*image.RGBA)
+		if !ok {
+			m = image.NewRGBA(image.Rect(0, 0, w, h))
+			draw.Draw(m, m.Bounds(), img, b.Min, draw.Src)
+		}
+		src, srcStride = m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride
+		d := image.NewRGBA(image.Rect(0, 0, dw, dh))
+		dst, dstPix, dstStride = d, d.Pix, d.Stride
+	}
+
+	// Source pixel (x, y) lands at base + x*stepX + y*stepY in dstPix
+	ds := dstStride
+	var base, stepX, stepY int
+	switch orientation {
+	case 2: // mirrored
+		base, stepX, stepY = (w-1)*4, -4, ds
+	case 3: // upside down
+		base, stepX, stepY = (h-1)*ds+(w-1)*4, -4, -ds
+	case 4: // mirrored upside down
+		base, stepX, stepY = (h-1)*ds, 4, -ds
+	case 5: // mirrored, rotated
+		base, stepX, stepY = 0, ds, 4
+	case 6: // rotated clockwise
+		base, stepX, stepY = (h-1)*4, ds, -4
+	case 7:
+		base, stepX, stepY = (w-1)*ds+(h-1)*4, -ds, -4
+	case 8: // rotated counter-clockwise
+		base, stepX, stepY = (w-1)*ds, -ds, 4
+	}
+
+	for y := 0; y < h; y++ {
+		row := src[y*srcStride : y*srcStride+w*4]
+		o := base + y*stepY
+		if stepX == 4 {
+			// Rows stay rows, so they move whole
+			copy(dstPix[o:o+w*4], row)
+			continue
+		}
+		for x := 0; x < w; x++ {
+			p := dstPix[o : o+4 : o+4]
+			s := row[x*4 : x*4+4 : x*4+4]
+			p[0], p[1], p[2], p[3] = s[0], s[1], s[2], s[3]
+			o += stepX
+		}
+	}
+	return dst
+}
+
+// saveImageVariants records the dimensions of each stored variant,
+// keyed by the original's file name (posts.image_path). A deduplicated
+// upload already has its rows, so existing ones are kept.
+func saveImageVariants(tx *sql.Tx, variants []storedVariant) error {
+	imagePath := variants[0].FileName
+	for _, v := range variants {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO image_variants (image_path, variant, file_name, width, height)
+			VALUES (?, ?, ?, ?, ?)`,
+			imagePath, v.Name, v.FileName, v.Width, v.Height)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetImageVariants returns the variants stored for an uploaded image.
+func GetImageVariants(db *sql.DB, store storage.BlobStore, imagePath string) (map[string]ImageVariant, error) {
+	rows, err := db.Query(`
+		SELECT variant, file_name, width, height
+		FROM image_variants
+		WHERE image_path = ?`, imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := map[string]ImageVariant{}
+	for rows.Next() {
+		var name, fileName string
+		var v ImageVariant
+		if err := rows.Scan(&name, &fileName, &v.Width, &v.Height); err != nil {
+			return nil, err
+		}
+		v.URL = store.URL(fileName)
+		variants[name] = v
+	}
+	return variants, rows.Err()
+}
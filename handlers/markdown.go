@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+)
+
+// markdown renders the CommonMark subset we support. Raw HTML in the
+// source is not passed through (goldmark's default), and the output is
+// run through contentPolicy before it is stored or sent to the client.
+var markdown = goldmark.New()
+
+var contentPolicy = newContentPolicy()
+
+// newContentPolicy builds the allow-list for rendered post content:
+// emphasis, links, code, lists and quotes. Everything else, including
+// scripts, event handler attributes and javascript: URLs, is stripped.
+func newContentPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "em", "strong", "code", "pre", "blockquote", "ul", "ol", "li", "hr")
+	p.AllowAttrs("start").Matching(regexp.MustCompile(`^[0-9]+$`)).OnElements("ol")
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.RequireParseableURLs(true)
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+// RenderContent converts Markdown post content into sanitized HTML.
+func RenderContent(content string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(content), &buf); err != nil {
+		return "", err
+	}
+	return contentPolicy.Sanitize(buf.String()), nil
+}
+
+// postContentHTML returns the cached HTML for a post, rendering it on
+// the fly if the row predates the content_html column.
+func postContentHTML(content string, cached sql.NullString) (string, error) {
+	if cached.Valid {
+		return cached.String, nil
+	}
+	return RenderContent(content)
+}
+
+// RenderMissingContent fills content_html for posts created before
+// Markdown rendering was added.
+func RenderMissingContent(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, content FROM posts WHERE content_html IS NULL")
+	if err != nil {
+		return err
+	}
+
+	pending := map[string]string{}
+	for rows.Next() {
+		var id, content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		pending[id] = content
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, content := range pending {
+		html, err := RenderContent(content)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE posts SET content_html = ? WHERE id = ?", html, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
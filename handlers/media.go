@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"postSPA/config"
+	"postSPA/problem"
+	"postSPA/storage"
+	"strings"
+)
+
+const (
+	maxAltTextLength = 500
+	maxContentLength = 64 * 1024
+	maxFieldLength   = 1024
+)
+
+// maxPostRequestSize bounds a whole create-post body: every image at
+// full size plus room for the text fields and multipart framing.
+func maxPostRequestSize(limits config.Uploads) int64 {
+	return int64(limits.MaxImages)*limits.MaxSize + 1024*1024
+}
+
+// Media is one image in a post's gallery.
+type Media struct {
+	Position  int    `json:"position"`
+	AltText   string `json:"alt_text"`
+	ImagePath string `json:"image_path"`
+	// Keyed by variant name (original, medium, thumbnail)
+	Variants map[string]ImageVariant `json:"variants"`
+}
+
+// uploadedImage is an image that has been processed and stored but not
+// yet attached to a post.
+type uploadedImage struct {
+	variants []storedVariant
+	altText  string
+}
+
+// uploadError describes a rejected form field with a message that is
+// safe to show the client.
+type uploadError struct {
+	field string
+	code  string // a problem.Field* code
+	msg   string
+}
+
+func (e uploadError) Error() string { return e.msg }
+
+func (e uploadError) fieldError() problem.FieldError {
+	return problem.FieldError{Field: e.field, Code: e.code, Message: e.msg}
+}
+
+// postForm is the parsed multipart body of a create-post request.
+type postForm struct {
+	content    string
+	categories []string
+	images     []uploadedImage
+}
+
+// readPostForm streams a multipart create-post body part by part, so no
+// part is buffered beyond its own limit and nothing is spooled to disk.
+// Images are stored as they arrive; each "alt" part is paired with the
+// "image" part at the same index. The returned errors are uploadErrors
+// whose text can be sent to the client. Files stored before a failure
+// are left for gc-uploads.
+func readPostForm(ctx context.Context, db *sql.DB, store storage.BlobStore, limits config.Uploads, mr *multipart.Reader) (postForm, error) {
+	var form postForm
+	var alts []string
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return form, uploadError{"image", problem.FieldTooLarge, "Request body too large"}
+			}
+			return form, uploadError{"", problem.FieldInvalid, "Invalid form"}
+		}
+
+		switch part.FormName() {
+		case "content":
+			form.content, err = readFormValue(part, maxContentLength)
+		case "categories":
+			var catID string
+			catID, err = readFormValue(part, maxFieldLength)
+			form.categories = append(form.categories, catID)
+		case "alt":
+			var altText string
+			altText, err = readFormValue(part, maxAltTextLength)
+			alts = append(alts, strings.TrimSpace(altText))
+		case "image":
+			if len(form.images) == limits.MaxImages {
+				err = uploadError{"image", problem.FieldTooMany, fmt.Sprintf("A post can have at most %d images", limits.MaxImages)}
+				break
+			}
+			var img uploadedImage
+			img, err = readImagePart(ctx, db, store, limits, part)
+			form.images = append(form.images, img)
+		}
+		part.Close()
+		if err != nil {
+			return form, err
+		}
+	}
+
+	for i := range form.images {
+		if i < len(alts) {
+			form.images[i].altText = alts[i]
+		}
+	}
+	return form, nil
+}
+
+// readFormValue reads a text part, rejecting it if it exceeds limit bytes.
+func readFormValue(part *multipart.Part, limit int64) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(part, limit+1))
+	if err != nil {
+		return "", uploadError{part.FormName(), problem.FieldInvalid, "Invalid form"}
+	}
+	if int64(len(data)) > limit {
+		return "", uploadError{part.FormName(), problem.FieldTooLong, fmt.Sprintf("Field %q is too long", part.FormName())}
+	}
+	return string(data), nil
+}
+
+// readImagePart reads one image part, stopping as soon as it exceeds
+// limits.MaxSize, and stores it. The type is sniffed from the bytes; the
+// client's file name and Content-Type are ignored.
+func readImagePart(ctx context.Context, db *sql.DB, store storage.BlobStore, limits config.Uploads, part *multipart.Part) (uploadedImage, error) {
+	data, err := io.ReadAll(io.LimitReader(part, limits.MaxSize+1))
+	if err != nil || len(data) == 0 {
+		return uploadedImage{}, uploadError{"image", problem.FieldInvalid, "Invalid file"}
+	}
+	if int64(len(data)) > limits.MaxSize {
+		return uploadedImage{}, uploadError{"image", problem.FieldTooLarge, fmt.Sprintf("File too large (max %dMB)", limits.MaxSize/(1024*1024))}
+	}
+
+	filetype := http.DetectContentType(data)
+	if filetype != "image/jpeg" && filetype != "image/png" && filetype != "image/gif" {
+		return uploadedImage{}, uploadError{"image", problem.FieldInvalid, "Only JPEG, PNG and GIF images are allowed"}
+	}
+
+	variants, err := storeImage(ctx, db, store, limits, data, filetype)
+	if err != nil {
+		slog.ErrorContext(ctx, "error processing upload", "err", err)
+		return uploadedImage{}, uploadError{"image", problem.FieldInvalid, "Invalid image"}
+	}
+	return uploadedImage{variants: variants}, nil
+}
+
+// storeImage names an upload after the SHA-256 of its bytes. If the same
+// bytes were uploaded before, the stored variants are reused; otherwise
+// the image is decoded, stripped and resized.
+func storeImage(ctx context.Context, db *sql.DB, store storage.BlobStore, limits config.Uploads, data []byte, filetype string) ([]storedVariant, error) {
+	sum := sha256.Sum256(data)
+	base := hex.EncodeToString(sum[:])
+
+	variants, err := findStoredImage(db, base+originalExt(filetype))
+	if err != nil {
+		return nil, err
+	}
+	if variants != nil {
+		return variants, nil
+	}
+
+	// Decode, strip metadata and generate the resized variants
+	return processUpload(ctx, store, limits, data, filetype, base)
+}
+
+// originalExt is the extension processUpload gives the original file.
+func originalExt(filetype string) string {
+	switch filetype {
+	case "image/jpeg":
+		return jpegEncoding.ext
+	case "image/gif":
+		return ".gif"
+	default:
+		return pngEncoding.ext
+	}
+}
+
+// findStoredImage returns the variants of a previously stored upload, or
+// nil if there is none. A hit bumps last_used_at so a concurrent GC run
+// leaves the files alone while the new post is being saved.
+func findStoredImage(db *sql.DB, imagePath string) ([]storedVariant, error) {
+	res, err := db.Exec("UPDATE uploads SET last_used_at = CURRENT_TIMESTAMP WHERE image_path = ?", imagePath)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT variant, file_name, width, height
+		FROM image_variants
+		WHERE image_path = ?`, imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byName := map[string]storedVariant{}
+	for rows.Next() {
+		var v storedVariant
+		if err := rows.Scan(&v.Name, &v.FileName, &v.Width, &v.Height); err != nil {
+			return nil, err
+		}
+		byName[v.Name] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	variants := []storedVariant{}
+	for _, name := range []string{VariantOriginal, VariantMedium, VariantThumbnail} {
+		v, ok := byName[name]
+		if !ok {
+			// Incomplete record, process the upload again
+			return nil, nil
+		}
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// savePostMedia records the gallery of a new post, in upload order.
+func savePostMedia(tx *sql.Tx, postID string, images []uploadedImage) error {
+	for position, img := range images {
+		if err := saveImageVariants(tx, img.variants); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			INSERT INTO post_media (post_id, position, image_path, alt_text)
+			VALUES (?, ?, ?, ?)`,
+			postID, position, img.variants[0].FileName, img.altText)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPostMedia returns a post's images ordered by position.
+func GetPostMedia(db *sql.DB, store storage.BlobStore, postID string) ([]Media, error) {
+	rows, err := db.Query(`
+		SELECT position, image_path, alt_text
+		FROM post_media
+		WHERE post_id = ?
+		ORDER BY position`, postID)
+	if err != nil {
+		return nil, err
+	}
+
+	media := []Media{}
+	for rows.Next() {
+		var m Media
+		if err := rows.Scan(&m.Position, &m.ImagePath, &m.AltText); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		media = append(media, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range media {
+		media[i].Variants, err = GetImageVariants(db, store, media[i].ImagePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return media, nil
+}
+
+// loadPostImages fills in the image fields of a post read from the
+// posts table. Posts created before galleries existed have an
+// image_path but no post_media rows; they get a single-item gallery so
+// clients can rely on media alone.
+func loadPostImages(db *sql.DB, store storage.BlobStore, post *Post, imagePath sql.NullString) error {
+	var err error
+	post.Media, err = GetPostMedia(db, store, post.ID)
+	if err != nil {
+		return err
+	}
+
+	if !imagePath.Valid {
+		return nil
+	}
+	post.ImagePath = &imagePath.String
+
+	post.ImageVariants, err = GetImageVariants(db, store, imagePath.String)
+	if err != nil {
+		return err
+	}
+
+	if len(post.Media) == 0 {
+		post.Media = append(post.Media, Media{
+			ImagePath: imagePath.String,
+			Variants:  post.ImageVariants,
+		})
+	}
+	return nil
+}
+
+// writeUploadError reports a readPostForm failure. Oversized files get a
+// 413; every other rejected field is a validation error.
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var ue uploadError
+	if !errors.As(err, &ue) {
+		writeInternalError(w, r, "error reading post form", err)
+		return
+	}
+	if ue.code == problem.FieldTooLarge {
+		p := problem.New(http.StatusRequestEntityTooLarge, problem.CodePayloadTooLarge, ue.msg)
+		p.Errors = []problem.FieldError{ue.fieldError()}
+		problem.Write(w, r, p)
+		return
+	}
+	writeValidationError(w, r, ue.fieldError())
+}
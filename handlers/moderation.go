@@ -0,0 +1,577 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"postSPA/problem"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// User roles. Moderators work the report queue; admins can do anything
+// a moderator can.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Report states. A report is open until a moderator acts on its target
+// or dismisses it.
+const (
+	ReportOpen      = "open"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+// What a moderator can do about a report. hide and remove apply to the
+// reported post or comment; warn and suspend to its author, or to the
+// reported user.
+const (
+	ActionDismiss = "dismiss"
+	ActionHide    = "hide"
+	ActionRemove  = "remove"
+	ActionWarn    = "warn"
+	ActionSuspend = "suspend"
+)
+
+const (
+	maxReportNoteLength = 1000
+	maxSuspendDays      = 365
+)
+
+var reportReasons = []string{"spam", "harassment", "hate", "violence", "sexual", "other"}
+
+// moderatedTables are the report targets that can be hidden or removed.
+var moderatedTables = map[string]string{"post": "posts", "comment": "comments"}
+
+// Shown to the author of hidden content, the only one who still sees it
+const (
+	hiddenPostNotice    = "A moderator hid this post. Only you can see it."
+	hiddenCommentNotice = "A moderator hid this comment. Only you can see it."
+)
+
+// Report is a user's report and, once resolved, what was done about it.
+// TargetUserID is the reported user or the author of the reported
+// content; TargetContent is the reported content, null for users.
+type Report struct {
+	ID             string     `json:"id"`
+	ReporterID     string     `json:"reporter_id"`
+	TargetType     string     `json:"target_type"`
+	TargetID       string     `json:"target_id"`
+	TargetUserID   *string    `json:"target_user_id"`
+	TargetContent  *string    `json:"target_content"`
+	Reason         string     `json:"reason"`
+	Note           string     `json:"note"`
+	Status         string     `json:"status"`
+	Action         *string    `json:"action"`
+	ResolutionNote *string    `json:"resolution_note"`
+	ResolvedBy     *string    `json:"resolved_by"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// Warning is a message a moderator sent a user about their conduct.
+type Warning struct {
+	ID        string    `json:"id"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// visibleContent is a condition that the post or comment aliased as
+// alias has not been moderated, or is hidden but written by the viewer.
+// It takes the viewer's ID, which may be "".
+func visibleContent(alias string) string {
+	return "(" + alias + ".moderation IS NULL OR (" + alias + ".moderation = 'hidden' AND " + alias + ".user_id = ?))"
+}
+
+// visibleTo is visibleContent for a loaded post.
+func (p Post) visibleTo(viewerID string) bool {
+	return p.moderation == "" || (p.moderation == "hidden" && p.UserID == viewerID)
+}
+
+// requireModerator returns the logged-in user's ID if they are a
+// moderator or admin, or writes a 401 or 403.
+func requireModerator(w http.ResponseWriter, r *http.Request, db *sql.DB) (string, bool) {
+	return requireRole(w, r, db, "Only moderators can do this", RoleModerator, RoleAdmin)
+}
+
+// requireAdmin returns the logged-in user's ID if they are an admin, or
+// writes a 401 or 403.
+func requireAdmin(w http.ResponseWriter, r *http.Request, db *sql.DB) (string, bool) {
+	return requireRole(w, r, db, "Only admins can do this", RoleAdmin)
+}
+
+func requireRole(w http.ResponseWriter, r *http.Request, db *sql.DB, detail string, roles ...string) (string, bool) {
+	userID, ok := requireUser(w, r, db)
+	if !ok {
+		return "", false
+	}
+	var role string
+	if err := db.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role); err != nil {
+		writeInternalError(w, r, "error loading role", err)
+		return "", false
+	}
+	if !slices.Contains(roles, role) {
+		writeError(w, r, http.StatusForbidden, problem.CodeForbidden, detail)
+		return "", false
+	}
+	return userID, true
+}
+
+// SetRole gives the user named username one of the Role constants and
+// records the change in the audit log, with no actor.
+func SetRole(db *sql.DB, username, role string) error {
+	if role != RoleUser && role != RoleModerator && role != RoleAdmin {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	var userID, previous string
+	err := db.QueryRow("SELECT id, role FROM users WHERE username = ?", username).Scan(&userID, &previous)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user named %q", username)
+	} else if err != nil {
+		return err
+	}
+	if previous == role {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", role, userID); err != nil {
+		return err
+	}
+	err = appendAuditEvent(context.Background(), tx, auditEntry{action: AuditRoleChange, targetType: "user", targetID: userID,
+		details: map[string]any{"role": role, "previous_role": previous}}, "", "")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// submitReport files a report from the body for the caller. A user can
+// have one open report per target.
+func submitReport(w http.ResponseWriter, r *http.Request, db *sql.DB) (Report, bool) {
+	userID, ok := requireUser(w, r, db)
+	if !ok {
+		return Report{}, false
+	}
+
+	var req struct {
+		TargetType string `json:"target_type"`
+		TargetID   string `json:"target_id"`
+		Reason     string `json:"reason"`
+		Note       string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeInvalidBody(w, r)
+		return Report{}, false
+	}
+	req.Note = strings.TrimSpace(req.Note)
+
+	var fields []problem.FieldError
+	if req.TargetType != "post" && req.TargetType != "comment" && req.TargetType != "user" {
+		fields = append(fields, problem.FieldError{Field: "target_type", Code: problem.FieldInvalid,
+			Message: "target_type must be post, comment or user"})
+	}
+	if req.TargetID == "" {
+		fields = append(fields, problem.FieldError{Field: "target_id", Code: problem.FieldRequired,
+			Message: "target_id is required"})
+	}
+	if !slices.Contains(reportReasons, req.Reason) {
+		fields = append(fields, problem.FieldError{Field: "reason", Code: problem.FieldInvalid,
+			Message: "reason must be one of " + strings.Join(reportReasons, ", ")})
+	}
+	if len(req.Note) > maxReportNoteLength {
+		fields = append(fields, problem.FieldError{Field: "note", Code: problem.FieldTooLong,
+			Message: fmt.Sprintf("note can be at most %d characters", maxReportNoteLength)})
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, r, fields...)
+		return Report{}, false
+	}
+
+	// Only what the reporter can see can be reported
+	var query string
+	switch req.TargetType {
+	case "post":
+		query = "SELECT EXISTS (SELECT 1 FROM posts p WHERE p.id = ? AND " + visibleContent("p") + ")"
+	case "comment":
+		query = "SELECT EXISTS (SELECT 1 FROM comments c WHERE c.id = ? AND " + visibleContent("c") + ")"
+	case "user":
+		query = "SELECT EXISTS (SELECT 1 FROM users WHERE id = ? AND id != ?)"
+	}
+	var exists bool
+	if err := db.QueryRow(query, req.TargetID, userID).Scan(&exists); err != nil {
+		writeInternalError(w, r, "error loading report target", err)
+		return Report{}, false
+	}
+	if !exists {
+		writeValidationError(w, r, problem.FieldError{Field: "target_id", Code: problem.FieldInvalid,
+			Message: "No " + req.TargetType + " with this ID can be reported"})
+		return Report{}, false
+	}
+
+	reportID := uuid.New().String()
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return Report{}, false
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		INSERT INTO reports (id, reporter_id, target_type, target_id, reason, note)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`,
+		reportID, userID, req.TargetType, req.TargetID, req.Reason, req.Note)
+	if err != nil {
+		writeInternalError(w, r, "error creating report", err)
+		return Report{}, false
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		writeInternalError(w, r, "error creating report", err)
+		return Report{}, false
+	} else if n == 0 {
+		writeError(w, r, http.StatusConflict, problem.CodeConflict, "You already reported this and it is still open")
+		return Report{}, false
+	}
+
+	err = recordAudit(tx, r, auditEntry{actorID: userID, action: AuditReportCreate, targetType: "report", targetID: reportID,
+		details: map[string]any{"target_type": req.TargetType, "target_id": req.TargetID, "reason": req.Reason}})
+	if err != nil {
+		writeInternalError(w, r, "error recording audit event", err)
+		return Report{}, false
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error creating report", err)
+		return Report{}, false
+	}
+
+	report, err := getReport(db, reportID)
+	if err != nil {
+		writeInternalError(w, r, "error fetching created report", err)
+		return Report{}, false
+	}
+	return report, true
+}
+
+// reportColumns selects a Report from reports r with its target.
+const reportColumns = `r.id, r.reporter_id, r.target_type, r.target_id,
+	COALESCE(p.user_id, c.user_id, tu.id), COALESCE(p.content, c.content),
+	r.reason, r.note, r.status, r.action, r.resolution_note, r.resolved_by, r.resolved_at, r.created_at`
+
+const reportFrom = `FROM reports r
+	LEFT JOIN posts p ON r.target_type = 'post' AND p.id = r.target_id
+	LEFT JOIN comments c ON r.target_type = 'comment' AND c.id = r.target_id
+	LEFT JOIN users tu ON r.target_type = 'user' AND tu.id = r.target_id`
+
+func scanReport(row rowScanner) (Report, error) {
+	var rp Report
+	var targetUserID, targetContent, action, resolutionNote, resolvedBy sql.NullString
+	var resolvedAt sql.NullTime
+	err := row.Scan(&rp.ID, &rp.ReporterID, &rp.TargetType, &rp.TargetID,
+		&targetUserID, &targetContent, &rp.Reason, &rp.Note, &rp.Status,
+		&action, &resolutionNote, &resolvedBy, &resolvedAt, &rp.CreatedAt)
+	rp.TargetUserID = nullString(targetUserID)
+	rp.TargetContent = nullString(targetContent)
+	rp.Action = nullString(action)
+	rp.ResolutionNote = nullString(resolutionNote)
+	rp.ResolvedBy = nullString(resolvedBy)
+	if resolvedAt.Valid {
+		rp.ResolvedAt = &resolvedAt.Time
+	}
+	return rp, err
+}
+
+// getReport returns one report, or sql.ErrNoRows.
+func getReport(db *sql.DB, id string) (Report, error) {
+	return scanReport(db.QueryRow("SELECT "+reportColumns+" "+reportFrom+" WHERE r.id = ?", id))
+}
+
+// listReports returns a page of the reports in status and how many
+// there are. Open reports come oldest first, as a queue; resolved ones
+// most recently resolved first.
+func listReports(db *sql.DB, status string, limit, offset int) ([]Report, int, error) {
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM reports WHERE status = ?", status).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("cannot count reports: %w", err)
+	}
+
+	order := "r.created_at, r.id"
+	if status != ReportOpen {
+		order = "r.resolved_at DESC, r.id DESC"
+	}
+	rows, err := db.Query("SELECT "+reportColumns+" "+reportFrom+`
+		WHERE r.status = ?
+		ORDER BY `+order+`
+		LIMIT ? OFFSET ?`, status, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list reports: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		rp, err := scanReport(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot read report row: %w", err)
+		}
+		reports = append(reports, rp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot list reports: %w", err)
+	}
+	return reports, total, nil
+}
+
+// readReportStatus parses the status query parameter, open by default.
+func readReportStatus(w http.ResponseWriter, r *http.Request) (string, bool) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		return ReportOpen, true
+	case ReportOpen, ReportActioned, ReportDismissed:
+		return status, true
+	}
+	writeValidationError(w, r, problem.FieldError{Field: "status", Code: problem.FieldInvalid,
+		Message: "status must be one of open, actioned or dismissed"})
+	return "", false
+}
+
+// resolveReport applies the moderator's decision in the body to the
+// report in the path. Every open report on the same target is resolved
+// with it, in one transaction.
+func resolveReport(w http.ResponseWriter, r *http.Request, db *sql.DB) (Report, bool) {
+	moderatorID, ok := requireModerator(w, r, db)
+	if !ok {
+		return Report{}, false
+	}
+
+	var req struct {
+		Action      string `json:"action"`
+		Note        string `json:"note"`
+		SuspendDays int    `json:"suspend_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeInvalidBody(w, r)
+		return Report{}, false
+	}
+	req.Note = strings.TrimSpace(req.Note)
+
+	var fields []problem.FieldError
+	switch req.Action {
+	case ActionDismiss, ActionHide, ActionRemove, ActionWarn, ActionSuspend:
+	default:
+		fields = append(fields, problem.FieldError{Field: "action", Code: problem.FieldInvalid,
+			Message: "action must be one of dismiss, hide, remove, warn or suspend"})
+	}
+	if len(req.Note) > maxReportNoteLength {
+		fields = append(fields, problem.FieldError{Field: "note", Code: problem.FieldTooLong,
+			Message: fmt.Sprintf("note can be at most %d characters", maxReportNoteLength)})
+	} else if req.Action == ActionWarn && req.Note == "" {
+		fields = append(fields, problem.FieldError{Field: "note", Code: problem.FieldRequired,
+			Message: "A warning needs a note, which is sent to the user"})
+	}
+	if req.Action == ActionSuspend && (req.SuspendDays < 1 || req.SuspendDays > maxSuspendDays) {
+		fields = append(fields, problem.FieldError{Field: "suspend_days", Code: problem.FieldInvalid,
+			Message: fmt.Sprintf("suspend_days must be from 1 to %d", maxSuspendDays)})
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, r, fields...)
+		return Report{}, false
+	}
+
+	report, err := getReport(db, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Report not found")
+		return Report{}, false
+	} else if err != nil {
+		writeInternalError(w, r, "error loading report", err)
+		return Report{}, false
+	}
+	if report.Status != ReportOpen {
+		writeError(w, r, http.StatusConflict, problem.CodeConflict, "Report is already resolved")
+		return Report{}, false
+	}
+
+	table, moderated := moderatedTables[report.TargetType]
+	if (req.Action == ActionHide || req.Action == ActionRemove) && !moderated {
+		writeValidationError(w, r, problem.FieldError{Field: "action", Code: problem.FieldInvalid,
+			Message: "Only posts and comments can be hidden or removed"})
+		return Report{}, false
+	}
+	if report.TargetUserID == nil {
+		writeError(w, r, http.StatusConflict, problem.CodeConflict, "The reported content no longer exists")
+		return Report{}, false
+	}
+	targetUserID := *report.TargetUserID
+	if req.Action == ActionSuspend && !requireSuspendable(w, r, db, moderatorID, targetUserID) {
+		return Report{}, false
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return Report{}, false
+	}
+	defer tx.Rollback()
+
+	status := ReportActioned
+	if req.Action == ActionDismiss {
+		status = ReportDismissed
+	}
+	// Resolving the report first takes the write lock, so of two
+	// moderators resolving it at once only the first gets to act
+	res, err := tx.Exec(`
+		UPDATE reports
+		SET status = ?, action = ?, resolution_note = ?, resolved_by = ?, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = 'open'`,
+		status, req.Action, req.Note, moderatorID, report.ID)
+	if err != nil {
+		writeInternalError(w, r, "error resolving report", err)
+		return Report{}, false
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		writeInternalError(w, r, "error resolving report", err)
+		return Report{}, false
+	} else if n == 0 {
+		writeError(w, r, http.StatusConflict, problem.CodeConflict, "Report is already resolved")
+		return Report{}, false
+	}
+
+	// What the action did to its target, for the audit log
+	var effect auditEntry
+	switch req.Action {
+	case ActionHide:
+		_, err = tx.Exec("UPDATE "+table+" SET moderation = 'hidden' WHERE id = ?", report.TargetID)
+		effect = auditEntry{action: AuditContentHide, targetType: report.TargetType, targetID: report.TargetID}
+	case ActionRemove:
+		_, err = tx.Exec("UPDATE "+table+" SET moderation = 'removed' WHERE id = ?", report.TargetID)
+		effect = auditEntry{action: AuditContentRemove, targetType: report.TargetType, targetID: report.TargetID}
+	case ActionWarn:
+		_, err = tx.Exec(`
+			INSERT INTO user_warnings (id, user_id, moderator_id, report_id, message)
+			VALUES (?, ?, ?, ?, ?)`,
+			uuid.New().String(), targetUserID, moderatorID, report.ID, req.Note)
+		effect = auditEntry{action: AuditWarn, targetType: "user", targetID: targetUserID,
+			details: map[string]any{"message": req.Note}}
+	case ActionSuspend:
+		until := time.Now().UTC().AddDate(0, 0, req.SuspendDays)
+		reason := req.Note
+		if reason == "" {
+			reason = "Reported for " + report.Reason
+		}
+		_, err = suspendUser(tx, AccountAction{UserID: targetUserID, ActorID: moderatorID,
+			Reason: reason, Until: &until, ReportID: &report.ID})
+		effect = auditEntry{action: AuditSuspend, targetType: "user", targetID: targetUserID,
+			details: map[string]any{"reason": reason, "until": until}}
+	}
+	if err != nil {
+		writeInternalError(w, r, "error applying moderation action", err)
+		return Report{}, false
+	}
+	// Hiding or removing held content settles its hold too
+	if req.Action == ActionHide || req.Action == ActionRemove {
+		_, err = tx.Exec("DELETE FROM content_holds WHERE target_type = ? AND target_id = ?", report.TargetType, report.TargetID)
+		if err != nil {
+			writeInternalError(w, r, "error resolving hold", err)
+			return Report{}, false
+		}
+		if report.TargetType == "comment" {
+			if err := refreshCommentPostScores(tx, report.TargetID); err != nil {
+				writeInternalError(w, r, "error updating post scores", err)
+				return Report{}, false
+			}
+		}
+	}
+
+	// The action settles the target's other open reports too
+	_, err = tx.Exec(`
+		UPDATE reports
+		SET status = ?, action = ?, resolution_note = ?, resolved_by = ?, resolved_at = CURRENT_TIMESTAMP
+		WHERE target_type = ? AND target_id = ? AND status = 'open'`,
+		status, req.Action, req.Note, moderatorID, report.TargetType, report.TargetID)
+	if err != nil {
+		writeInternalError(w, r, "error resolving reports", err)
+		return Report{}, false
+	}
+
+	err = recordAudit(tx, r, auditEntry{actorID: moderatorID, action: AuditReportResolve, targetType: "report", targetID: report.ID,
+		details: map[string]any{"action": req.Action, "note": req.Note,
+			"target_type": report.TargetType, "target_id": report.TargetID}})
+	if err != nil {
+		writeInternalError(w, r, "error recording audit event", err)
+		return Report{}, false
+	}
+	if effect.action != "" {
+		effect.actorID = moderatorID
+		if effect.details == nil {
+			effect.details = map[string]any{}
+		}
+		effect.details["report_id"] = report.ID
+		if err := recordAudit(tx, r, effect); err != nil {
+			writeInternalError(w, r, "error recording audit event", err)
+			return Report{}, false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error resolving reports", err)
+		return Report{}, false
+	}
+
+	report, err = getReport(db, report.ID)
+	if err != nil {
+		writeInternalError(w, r, "error fetching resolved report", err)
+		return Report{}, false
+	}
+	return report, true
+}
+
+// listWarnings returns a page of the warnings sent to userID, newest
+// first, and how many there are.
+func listWarnings(db *sql.DB, userID string, limit, offset int) ([]Warning, int, error) {
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM user_warnings WHERE user_id = ?", userID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("cannot count warnings: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, message, created_at
+		FROM user_warnings
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?`, userID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list warnings: %w", err)
+	}
+	defer rows.Close()
+
+	warnings := []Warning{}
+	for rows.Next() {
+		var wn Warning
+		if err := rows.Scan(&wn.ID, &wn.Message, &wn.CreatedAt); err != nil {
+			return nil, 0, fmt.Errorf("cannot read warning row: %w", err)
+		}
+		warnings = append(warnings, wn)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot list warnings: %w", err)
+	}
+	return warnings, total, nil
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
@@ -3,193 +3,562 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"io"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"postSPA/config"
+	"postSPA/middleware"
+	"postSPA/problem"
+	"postSPA/storage"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-const (
-	uploadDir     = "./static/uploads"
-	maxUploadSize = 20 * 1024 * 1024 // 20MB
-)
+type Post struct {
+	ID          string  `json:"id"`
+	UserID      string  `json:"user_id"`
+	Username    string  `json:"username"`
+	Content     string  `json:"content"`
+	ContentHTML string  `json:"content_html"`
+	ImagePath   *string `json:"image_path,omitempty"`
+	// Keyed by variant name (original, medium, thumbnail)
+	ImageVariants map[string]ImageVariant `json:"image_variants,omitempty"`
+	Media         []Media                 `json:"media"`
+	Categories    []string                `json:"categories"`
+	LikesCount    int                     `json:"likes_count"`
+	DislikesCount int                     `json:"dislikes_count"`
+	CommentsCount int                     `json:"comments_count"`
+	// The viewer's own reaction, "like" or "dislike"; null for none
+	// or an anonymous viewer
+	UserReaction *string `json:"user_reaction"`
+	// Set when a moderator hid the post, or a content check held it for
+	// one, which only its author still sees
+	ModerationNotice *string `json:"moderation_notice"`
+	// What the content checks made of a new or edited post
+	ContentChecks []problem.CheckResult `json:"content_checks,omitempty"`
+	CreatedAt     time.Time             `json:"created_at"`
+
+	moderation string // "", "hidden" or "removed"
+}
 
-func init() {
-	// Create upload directory if it doesn't exist
-	os.MkdirAll(uploadDir, 0755)
+func CreatePostHandler(db *sql.DB, store storage.BlobStore, limits config.Uploads, checks ContentChecks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, ok := submitPost(w, r, db, store, limits, checks)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusCreated, post)
+	}
 }
 
-type Post struct {
-	ID            string    `json:"id"`
-	UserID        string    `json:"user_id"`
-	Username      string    `json:"username"`
-	Content       string    `json:"content"`
-	ImagePath     *string   `json:"image_path,omitempty"`
-	Categories    []string  `json:"categories"`
-	LikesCount    int       `json:"likes_count"`
-	DislikesCount int       `json:"dislikes_count"`
-	CommentsCount int       `json:"comments_count"`
-	CreatedAt     time.Time `json:"created_at"`
+// UpdatePostHandler lets the author change a post's content. The cached
+// HTML is regenerated from the new Markdown in the same statement.
+func UpdatePostHandler(db *sql.DB, checks ContentChecks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		update, ok := submitPostEdit(w, r, db, checks)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, update)
+	}
 }
 
-func CreatePostHandler(db *sql.DB) http.HandlerFunc {
+func ListPostsHandler(db *sql.DB, store storage.BlobStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Check authentication first
-		userID, err := getAuthenticatedUserID(db, r)
+		sort, window, ok := readSort(w, r)
+		if !ok {
+			return
+		}
+		viewer := viewerID(db, r)
+		q := postQuery{sort: sort, window: window, viewerID: viewer, mutedFor: viewer, limit: 50}
+		posts, _, err := listPosts(db, store, q)
 		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeInternalError(w, r, "error listing posts", err)
 			return
 		}
+		writeJSON(w, http.StatusOK, posts)
+	}
+}
 
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+// submitPost creates a post from a JSON or multipart body and returns
+// it as stored. The content goes through checks first, and the post is
+// held for a moderator if one of them asks.
+func submitPost(w http.ResponseWriter, r *http.Request, db *sql.DB, store storage.BlobStore, limits config.Uploads, checks ContentChecks) (Post, bool) {
+	// Check authentication first
+	userID, ok := requireUser(w, r, db)
+	if !ok {
+		return Post{}, false
+	}
+
+	// Variables to hold post data
+	var content string
+	var categories []string
+	var images []uploadedImage
+
+	// Check content type
+	contentType := r.Header.Get("Content-Type")
+
+	if strings.HasPrefix(contentType, "application/json") {
+		// JSON request (text-only post)
+		var post struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+			writeInvalidBody(w, r)
+			return Post{}, false
+		}
+		content = post.Content
+	} else if strings.HasPrefix(contentType, "multipart/form-data") {
+		// Multipart form (possible file uploads), read as a stream
+		// so oversized parts are rejected before they are buffered
+		r.Body = http.MaxBytesReader(w, r.Body, maxPostRequestSize(limits))
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid form")
+			return Post{}, false
 		}
 
-		// Variables to hold post data
-		var content string
-		var imagePath sql.NullString
-
-		// Check content type
-		contentType := r.Header.Get("Content-Type")
-
-		if strings.HasPrefix(contentType, "application/json") {
-			// JSON request (text-only post)
-			var post struct {
-				Content string `json:"content"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
-				http.Error(w, "Invalid request", http.StatusBadRequest)
-				return
-			}
-			content = post.Content
-		} else if strings.HasPrefix(contentType, "multipart/form-data") {
-			// Multipart form (possible file upload)
-			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-				http.Error(w, "File too large or invalid form", http.StatusBadRequest)
-				return
-			}
-
-			content = r.FormValue("content")
-			file, fileHeader, err := r.FormFile("image")
-			if err == nil {
-				defer file.Close()
-
-				// Validate file
-				if fileHeader.Size > maxUploadSize {
-					http.Error(w, "File too large (max 20MB)", http.StatusBadRequest)
-					return
-				}
-
-				buff := make([]byte, 512)
-				if _, err := file.Read(buff); err != nil {
-					http.Error(w, "Invalid file", http.StatusBadRequest)
-					return
-				}
-				if _, err := file.Seek(0, 0); err != nil {
-					http.Error(w, "File error", http.StatusInternalServerError)
-					return
-				}
-
-				filetype := http.DetectContentType(buff)
-				if filetype != "image/jpeg" && filetype != "image/png" && filetype != "image/gif" {
-					http.Error(w, "Only JPEG, PNG and GIF images are allowed", http.StatusBadRequest)
-					return
-				}
-
-				// Generate unique filename
-				ext := filepath.Ext(fileHeader.Filename)
-				newFileName := uuid.New().String() + ext
-				newFilePath := filepath.Join(uploadDir, newFileName)
-
-				// Save file
-				dst, err := os.Create(newFilePath)
-				if err != nil {
-					http.Error(w, "Failed to save file", http.StatusInternalServerError)
-					return
-				}
-				defer dst.Close()
-
-				if _, err := io.Copy(dst, file); err != nil {
-					http.Error(w, "Failed to save file", http.StatusInternalServerError)
-					return
-				}
-
-				imagePath = sql.NullString{String: newFileName, Valid: true}
-			} else if err != http.ErrMissingFile {
-				http.Error(w, "Invalid file upload", http.StatusBadRequest)
-				return
-			}
-		} else {
-			http.Error(w, "Unsupported content type", http.StatusBadRequest)
-			return
+		form, err := readPostForm(r.Context(), db, store, limits, mr)
+		if err != nil {
+			writeUploadError(w, r, err)
+			return Post{}, false
 		}
+		content = form.content
+		categories = form.categories
+		images = form.images
+	} else {
+		writeError(w, r, http.StatusUnsupportedMediaType, problem.CodeUnsupportedMedia,
+			"Send application/json or multipart/form-data")
+		return Post{}, false
+	}
 
-		// Validate at least content or image exists
-		if content == "" && !imagePath.Valid {
-			http.Error(w, "Post must have content or an image", http.StatusBadRequest)
-			return
+	// Validate at least content or image exists
+	if content == "" && len(images) == 0 {
+		writeValidationError(w, r, problem.FieldError{Field: "content", Code: problem.FieldRequired,
+			Message: "Post must have content or an image"})
+		return Post{}, false
+	}
+	if len(content) > maxContentLength {
+		writeValidationError(w, r, problem.FieldError{Field: "content", Code: problem.FieldTooLong,
+			Message: "Post content is too long"})
+		return Post{}, false
+	}
+
+	review, ok := reviewContent(w, r, db, checks, Submission{UserID: userID, Kind: "post", Text: content})
+	if !ok {
+		return Post{}, false
+	}
+	content = review.text
+	var holdReason string
+	if review.verdict == VerdictModerate {
+		holdReason = review.holdReason()
+	}
+
+	contentHTML, err := RenderContent(content)
+	if err != nil {
+		writeInternalError(w, r, "error rendering post content", err)
+		return Post{}, false
+	}
+
+	// Create post together with its images
+	postID := uuid.New().String()
+	err = createPost(db, r, postID, userID, content, contentHTML, images, holdReason)
+	if err != nil {
+		writeInternalError(w, r, "error creating post", err)
+		return Post{}, false
+	}
+
+	// Handle categories if they exist
+	for _, catID := range categories {
+		_, err := db.Exec("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)",
+			postID, catID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to add category to post", "category_id", catID, "post_id", postID, "err", err)
 		}
+	}
 
-		// Create post
-		postID := uuid.New().String()
-		_, err = db.Exec("INSERT INTO posts (id, user_id, content, image_path) VALUES (?, ?, ?, ?)",
-			postID, userID, content, imagePath)
+	// Fetch the complete post data to return to client
+	post, err := getPost(db, store, postID)
+	if err != nil {
+		writeInternalError(w, r, "error fetching created post", err)
+		return Post{}, false
+	}
+	post.ContentChecks = review.results
+	return post, true
+}
+
+// postUpdate is the result of an edit.
+type postUpdate struct {
+	ID            string                `json:"id"`
+	Content       string                `json:"content"`
+	ContentHTML   string                `json:"content_html"`
+	ContentChecks []problem.CheckResult `json:"content_checks,omitempty"`
+}
+
+// submitPostEdit replaces the content of the post in the path, if the
+// caller wrote it. The new content goes through checks like a new post.
+func submitPostEdit(w http.ResponseWriter, r *http.Request, db *sql.DB, checks ContentChecks) (postUpdate, bool) {
+	userID, ok := requireUser(w, r, db)
+	if !ok {
+		return postUpdate{}, false
+	}
+
+	postID := r.PathValue("id")
+
+	var request struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeInvalidBody(w, r)
+		return postUpdate{}, false
+	}
+
+	request.Content = strings.TrimSpace(request.Content)
+	if request.Content == "" {
+		writeValidationError(w, r, problem.FieldError{Field: "content", Code: problem.FieldRequired,
+			Message: "Post content cannot be empty"})
+		return postUpdate{}, false
+	}
+	if len(request.Content) > maxContentLength {
+		writeValidationError(w, r, problem.FieldError{Field: "content", Code: problem.FieldTooLong,
+			Message: "Post content is too long"})
+		return postUpdate{}, false
+	}
+
+	var authorID, previous string
+	err := db.QueryRow("SELECT user_id, content FROM posts WHERE id = ? AND moderation IS NOT 'removed'", postID).
+		Scan(&authorID, &previous)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Post not found")
+		return postUpdate{}, false
+	} else if err != nil {
+		writeInternalError(w, r, "error loading post", err)
+		return postUpdate{}, false
+	}
+	if authorID != userID {
+		writeError(w, r, http.StatusForbidden, problem.CodeForbidden, "Only the author can edit this post")
+		return postUpdate{}, false
+	}
+
+	review, ok := reviewContent(w, r, db, checks,
+		Submission{UserID: userID, Kind: "post", Text: request.Content, Editing: true})
+	if !ok {
+		return postUpdate{}, false
+	}
+	request.Content = review.text
+
+	contentHTML, err := RenderContent(request.Content)
+	if err != nil {
+		writeInternalError(w, r, "error rendering post content", err)
+		return postUpdate{}, false
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return postUpdate{}, false
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE posts SET content = ?, content_html = ? WHERE id = ?",
+		request.Content, contentHTML, postID)
+	if err != nil {
+		writeInternalError(w, r, "error updating post", err)
+		return postUpdate{}, false
+	}
+	err = recordAudit(tx, r, auditEntry{actorID: userID, action: AuditPostUpdate, targetType: "post", targetID: postID,
+		details: map[string]any{"previous_content": previous}})
+	if err != nil {
+		writeInternalError(w, r, "error recording audit event", err)
+		return postUpdate{}, false
+	}
+	if review.verdict == VerdictModerate {
+		if err := holdContent(tx, "post", postID, review.holdReason()); err != nil {
+			writeInternalError(w, r, "error holding post", err)
+			return postUpdate{}, false
+		}
+		err := recordAudit(tx, r, auditEntry{actorID: userID, action: AuditContentHold, targetType: "post", targetID: postID,
+			details: map[string]any{"reason": review.holdReason()}})
 		if err != nil {
-			http.Error(w, "Failed to create post", http.StatusInternalServerError)
-			return
+			writeInternalError(w, r, "error recording audit event", err)
+			return postUpdate{}, false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error updating post", err)
+		return postUpdate{}, false
+	}
+
+	return postUpdate{ID: postID, Content: request.Content, ContentHTML: contentHTML, ContentChecks: review.results}, true
+}
+
+// createPost inserts the post row and its gallery in one transaction,
+// holding the post for a moderator if holdReason is set, and records
+// both in the audit log as made by r. image_path keeps pointing at the
+// first image for older clients.
+func createPost(db *sql.DB, r *http.Request, postID, userID, content, contentHTML string, images []uploadedImage, holdReason string) error {
+	var imagePath sql.NullString
+	if len(images) > 0 {
+		imagePath = sql.NullString{String: images[0].variants[0].FileName, Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO posts (id, user_id, content, content_html, image_path) VALUES (?, ?, ?, ?, ?)",
+		postID, userID, content, contentHTML, imagePath)
+	if err != nil {
+		return err
+	}
+
+	if err := savePostMedia(tx, postID, images); err != nil {
+		return err
+	}
+
+	if holdReason != "" {
+		if err := holdContent(tx, "post", postID, holdReason); err != nil {
+			return err
 		}
+	}
 
-		// Handle categories if they exist
-		if categories := r.Form["categories"]; len(categories) > 0 {
-			for _, catID := range categories {
-				_, err := db.Exec("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)",
-					postID, catID)
-				if err != nil {
-					log.Printf("Failed to add category %s to post %s: %v", catID, postID, err)
+	if err := refreshPostScores(tx, postID); err != nil {
+		return err
+	}
 
-				}
-			}
+	err = recordAudit(tx, r, auditEntry{actorID: userID, action: AuditPostCreate, targetType: "post", targetID: postID})
+	if err != nil {
+		return err
+	}
+	if holdReason != "" {
+		err := recordAudit(tx, r, auditEntry{actorID: userID, action: AuditContentHold, targetType: "post", targetID: postID,
+			details: map[string]any{"reason": holdReason}})
+		if err != nil {
+			return err
 		}
+	}
+
+	return tx.Commit()
+}
+
+// postColumns are the columns scanPost reads, in order.
+const postColumns = `p.id, p.user_id, u.username, p.content, p.content_html, p.image_path,
+	p.likes_count, p.dislikes_count, p.comments_count, p.moderation, p.created_at,
+	EXISTS (SELECT 1 FROM content_holds h WHERE h.target_type = 'post' AND h.target_id = p.id)`
+
+// postRow is a posts row before the related data is loaded.
+type postRow struct {
+	post        Post
+	contentHTML sql.NullString
+	imagePath   sql.NullString
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPost(row rowScanner) (postRow, error) {
+	var pr postRow
+	var moderation sql.NullString
+	var held bool
+	err := row.Scan(&pr.post.ID, &pr.post.UserID, &pr.post.Username,
+		&pr.post.Content, &pr.contentHTML, &pr.imagePath,
+		&pr.post.LikesCount, &pr.post.DislikesCount, &pr.post.CommentsCount,
+		&moderation, &pr.post.CreatedAt, &held)
+	pr.post.moderation = moderation.String
+	if pr.post.moderation == "hidden" {
+		notice := hiddenPostNotice
+		if held {
+			notice = heldPostNotice
+		}
+		pr.post.ModerationNotice = &notice
+	}
+	return pr, err
+}
+
+// postQuery selects one page of posts in the given sort order, newest
+// first by default. Filters that are left empty do not apply.
+type postQuery struct {
+	sort       string // one of the Sort constants
+	window     string // for SortTop, one of the Window constants
+	categoryID string // only posts in this category
+	authorID   string // only posts by this user
+	likedBy    string // only posts this user liked
+	feedFor    string // only posts by users or in categories this user follows
+	mutedFor   string // leave out posts in categories this user muted
+	viewerID   string // fills in UserReaction, shows their hidden posts and hides users restricted either way
+	limit      int
+	offset     int
+}
+
+// listPosts returns the page of posts q selects, with every field
+// filled in, and the number of posts matching q over all pages.
+func listPosts(db *sql.DB, store storage.BlobStore, q postQuery) ([]Post, int, error) {
+	from := "FROM posts p JOIN users u ON p.user_id = u.id"
+	// Moderated posts are never listed, except hidden ones to their author
+	where := []string{visibleContent("p")}
+	args := []any{q.viewerID}
+	if q.categoryID != "" {
+		from += " JOIN post_categories pc ON p.id = pc.post_id"
+		where = append(where, "pc.category_id = ?")
+		args = append(args, q.categoryID)
+	}
+	if q.authorID != "" {
+		where = append(where, "p.user_id = ?")
+		args = append(args, q.authorID)
+	}
+	if q.likedBy != "" {
+		where = append(where, `EXISTS (
+			SELECT 1 FROM reactions r
+			WHERE r.post_id = p.id AND r.user_id = ? AND r.type = 'like')`)
+		args = append(args, q.likedBy)
+	}
+	if q.feedFor != "" {
+		where = append(where, `(
+			p.user_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)
+			OR p.id IN (
+				SELECT fc.post_id FROM post_categories fc
+				JOIN category_preferences cp ON cp.category_id = fc.category_id
+				WHERE cp.user_id = ? AND cp.preference = 'subscribed'))`)
+		args = append(args, q.feedFor, q.feedFor)
+	}
+	if q.mutedFor != "" {
+		where = append(where, `p.id NOT IN (
+			SELECT mc.post_id FROM post_categories mc
+			JOIN category_preferences cp ON cp.category_id = mc.category_id
+			WHERE cp.user_id = ? AND cp.preference = 'muted')`)
+		args = append(args, q.mutedFor)
+	}
+	if q.viewerID != "" {
+		where = append(where, visibleAuthor("p.user_id"))
+		args = append(args, q.viewerID, q.viewerID)
+	}
+	if q.sort == SortTop && topWindows[q.window] != "" {
+		where = append(where, "p.created_at >= datetime('now', ?)")
+		args = append(args, topWindows[q.window])
+	}
 
-		// Fetch the complete post data to return to client
-		var createdPost Post
-		var dbImagePath sql.NullString
-
-		err = db.QueryRow(`
-            SELECT p.id, p.user_id, u.username, p.content, p.image_path, p.created_at
-            FROM posts p
-            JOIN users u ON p.user_id = u.id
-            WHERE p.id = ?`, postID).
-			Scan(&createdPost.ID, &createdPost.UserID, &createdPost.Username,
-				&createdPost.Content, &dbImagePath, &createdPost.CreatedAt)
+	order, ok := sortOrders[q.sort]
+	if !ok {
+		order = sortOrders[SortNew]
+	}
+	from += " WHERE " + strings.Join(where, " AND ")
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) "+from, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("cannot count posts: %w", err)
+	}
+
+	rows, err := db.Query("SELECT "+postColumns+" "+from+" ORDER BY "+order+" LIMIT ? OFFSET ?",
+		append(args, q.limit, q.offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list posts: %w", err)
+	}
+
+	var page []postRow
+	for rows.Next() {
+		pr, err := scanPost(rows)
 		if err != nil {
-			http.Error(w, "Failed to fetch created post", http.StatusInternalServerError)
-			return
+			rows.Close()
+			return nil, 0, fmt.Errorf("cannot read post row: %w", err)
 		}
+		page = append(page, pr)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot list posts: %w", err)
+	}
 
-		// Convert NullString to *string
-		if dbImagePath.Valid {
-			createdPost.ImagePath = &dbImagePath.String
+	posts := []Post{}
+	for _, pr := range page {
+		if err := loadPostDetails(db, store, &pr); err != nil {
+			return nil, 0, err
 		}
+		posts = append(posts, pr.post)
+	}
+
+	if err := loadUserReactions(db, q.viewerID, posts); err != nil {
+		return nil, 0, err
+	}
+	return posts, total, nil
+}
 
-		categories, categErrs := GetPostCategories(db, createdPost.ID)
-		if categErrs != nil {
-			log.Println("error getting categories from db", categErrs)
-			http.Error(w, "An error occured, kindly check back later", http.StatusInternalServerError)
+// loadUserReactions sets UserReaction on each post to viewerID's own
+// reaction, using one query for the whole page.
+func loadUserReactions(db *sql.DB, viewerID string, posts []Post) error {
+	if viewerID == "" || len(posts) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*Post, len(posts))
+	args := []any{viewerID}
+	for i := range posts {
+		byID[posts[i].ID] = &posts[i]
+		args = append(args, posts[i].ID)
+	}
+
+	rows, err := db.Query(`
+		SELECT post_id, type
+		FROM reactions
+		WHERE user_id = ? AND comment_id IS NULL
+		AND post_id IN (?`+strings.Repeat(", ?", len(posts)-1)+`)`, args...)
+	if err != nil {
+		return fmt.Errorf("cannot load user reactions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID, reactionType string
+		if err := rows.Scan(&postID, &reactionType); err != nil {
+			return fmt.Errorf("cannot read user reaction: %w", err)
+		}
+		if post, ok := byID[postID]; ok {
+			post.UserReaction = &reactionType
 		}
+	}
+	return rows.Err()
+}
+
+// getPost returns one post with every field filled in, or sql.ErrNoRows.
+func getPost(db *sql.DB, store storage.BlobStore, postID string) (Post, error) {
+	pr, err := scanPost(db.QueryRow(`
+		SELECT `+postColumns+`
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.id = ?`, postID))
+	if err != nil {
+		return Post{}, err
+	}
+	if err := loadPostDetails(db, store, &pr); err != nil {
+		return Post{}, err
+	}
+	return pr.post, nil
+}
+
+// loadPostDetails fills in the rendered content, images and categories
+// of a scanned post.
+func loadPostDetails(db *sql.DB, store storage.BlobStore, pr *postRow) error {
+	post := &pr.post
+	var err error
 
-		createdPost.Categories = categories
+	post.ContentHTML, err = postContentHTML(post.Content, pr.contentHTML)
+	if err != nil {
+		return fmt.Errorf("cannot render post %s: %w", post.ID, err)
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(createdPost)
+	if err := loadPostImages(db, store, post, pr.imagePath); err != nil {
+		return fmt.Errorf("cannot load images of post %s: %w", post.ID, err)
 	}
+
+	post.Categories, err = GetPostCategories(db, post.ID)
+	if err != nil {
+		return fmt.Errorf("cannot load categories of post %s: %w", post.ID, err)
+	}
+	return nil
 }
 
 func GetPostCategories(db *sql.DB, id string) ([]string, error) {
@@ -209,20 +578,16 @@ func GetPostCategories(db *sql.DB, id string) ([]string, error) {
 	for rows.Next() {
 		var cat string
 		if err := rows.Scan(&cat); err != nil {
-			log.Fatalf("Error scanning category: %v", err)
+			return nil, err
 		}
 		categories = append(categories, cat)
 	}
 
-	return categories, nil
+	return categories, rows.Err()
 }
 
 func GetReactionCountsForPost(db *sql.DB, id string) (int, int, error) {
-	query := `
-		SELECT COUNT(*) FILTER (WHERE r.type = 'like'), COUNT(*) FILTER (WHERE r.type = 'dislike')
-		FROM reactions r
-		WHERE r.post_id = ?
-	`
+	query := "SELECT likes_count, dislikes_count FROM posts WHERE id = ?"
 	var likeCount, dislikeCount int
 	err := db.QueryRow(query, id).Scan(&likeCount, &dislikeCount)
 	if err != nil {
@@ -231,79 +596,19 @@ func GetReactionCountsForPost(db *sql.DB, id string) (int, int, error) {
 	return likeCount, dislikeCount, nil
 }
 
-func ListPostsHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		rows, err := db.Query(`
-			SELECT p.id, p.user_id, u.username, p.content, p.image_path, p.created_at
-			FROM posts p
-			JOIN users u ON p.user_id = u.id
-			ORDER BY p.created_at DESC
-			LIMIT 50`)
-		if err != nil {
-			log.Println("list post error", err)
-			http.Error(w, "Failed to fetch posts", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		posts := []Post{}
-		for rows.Next() {
-			var post Post
-			var imagePath sql.NullString // Use sql.NullString to handle NULL values
-
-			err := rows.Scan(&post.ID, &post.UserID, &post.Username,
-				&post.Content, &imagePath, &post.CreatedAt)
-			if err != nil {
-				log.Println("add post to array error", err)
-				http.Error(w, "Failed to read posts", http.StatusInternalServerError)
-				return
-			}
-
-			// Convert NullString to *string
-			// in templates the *string will be implicitly derefrenced
-			if imagePath.Valid {
-				post.ImagePath = &imagePath.String
-			} else {
-				post.ImagePath = nil
-			}
-
-			categories, categErrs := GetPostCategories(db, post.ID)
-			if categErrs != nil {
-				log.Println("error getting categories from db", categErrs)
-				http.Error(w, "An error occured, kindly check back later", http.StatusInternalServerError)
-			}
-			post.Categories = categories
-
-			likesCount, dislikesCount, reactionsErr := GetReactionCountsForPost(db, post.ID)
-			if reactionsErr != nil {
-				log.Println("error getting reactions count from db", reactionsErr)
-				http.Error(w, "An error occured, kindly check back later", http.StatusInternalServerError)
-			}
-			post.LikesCount = likesCount
-			post.DislikesCount = dislikesCount
-
-			commentsCount, commentCountErr := GetPostCommentCount(db, post.ID)
-			if commentCountErr != nil {
-				log.Fatalf("error in GetPostCommentCount: %v", commentCountErr)
-				http.Error(w, "An error occured try again later", http.StatusInternalServerError)
-				return
-			}
-
-			post.CommentsCount = commentsCount
-
-			posts = append(posts, post)
-		}
-
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(posts)
-	}
+// viewerID returns the logged-in user's ID, or "" for anonymous
+// requests. It is for endpoints that work without a session but say
+// more to a logged-in user.
+func viewerID(db *sql.DB, r *http.Request) string {
+	userID, _ := getAuthenticatedUserID(db, r)
+	return userID
 }
 
+// errSessionExpired is returned by getAuthenticatedUserID for a session
+// past its expiry, which the cookie alone doesn't stop the browser from
+// sending.
+var errSessionExpired = errors.New("session expired")
+
 // Helper function to get authenticated user ID
 func getAuthenticatedUserID(db *sql.DB, r *http.Request) (string, error) {
 	cookie, err := r.Cookie("session_id")
@@ -311,12 +616,28 @@ func getAuthenticatedUserID(db *sql.DB, r *http.Request) (string, error) {
 		return "", err
 	}
 
+	// Suspending a user deletes their sessions, but a suspension that
+	// started while a request was in flight must still lock them out
 	var userID string
-	err = db.QueryRow("SELECT user_id FROM sessions WHERE id = ?", cookie.Value).
-		Scan(&userID)
+	var expiresAt time.Time
+	var st standing
+	err = db.QueryRow(`
+		SELECT s.user_id, s.expires_at, `+standingColumns+`
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = ?`, cookie.Value).
+		Scan(&userID, &expiresAt, &st.suspendedUntil, &st.bannedAt, &st.reason)
 	if err != nil {
 		return "", err
 	}
+	if time.Now().After(expiresAt) {
+		return "", errSessionExpired
+	}
+	if detail := st.lockout(); detail != "" {
+		return "", lockedOutError{detail}
+	}
 
+	// Let the access log attribute the request
+	middleware.SetUserID(r.Context(), userID)
 	return userID, nil
 }
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"postSPA/problem"
+	"time"
+)
+
+// Post list orders, chosen with the sort query parameter. top also takes
+// a window parameter.
+const (
+	SortNew           = "new"
+	SortTop           = "top"
+	SortHot           = "hot"
+	SortControversial = "controversial"
+
+	WindowDay  = "day"
+	WindowWeek = "week"
+	WindowAll  = "all"
+)
+
+// sortOrders maps each sort to its ORDER BY clause. Every score column
+// is indexed, and newer posts win ties.
+var sortOrders = map[string]string{
+	SortNew:           "p.created_at DESC, p.id DESC",
+	SortTop:           "p.score DESC, p.created_at DESC, p.id DESC",
+	SortHot:           "p.hot_score DESC, p.id DESC",
+	SortControversial: "p.controversy_score DESC, p.created_at DESC, p.id DESC",
+}
+
+// topWindows limits sort=top to recent posts, as a SQLite datetime
+// modifier; all has no limit.
+var topWindows = map[string]string{
+	WindowDay:  "-1 day",
+	WindowWeek: "-7 days",
+	WindowAll:  "",
+}
+
+// hotEpoch and hotDecay set how fast posts cool down: a post needs ten
+// times the net votes to rank level with one posted hotDecay later.
+var hotEpoch = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const hotDecay = 12 * time.Hour
+
+// hotScore combines net votes and comments on a log scale with the
+// post's age. Newer posts score higher for the same activity, so the
+// score never has to be recomputed as time passes.
+func hotScore(likes, dislikes, comments int, createdAt time.Time) float64 {
+	net := float64(likes - dislikes)
+	votes := math.Log10(math.Max(math.Abs(net), 1))
+	if net < 0 {
+		votes = -votes
+	}
+	discussion := math.Log10(1+float64(comments)) / 2
+	age := createdAt.Sub(hotEpoch).Seconds() / hotDecay.Seconds()
+	return votes + discussion + age
+}
+
+// controversyScore is high for posts with many votes split evenly
+// between likes and dislikes, and zero for one-sided posts.
+func controversyScore(likes, dislikes int) float64 {
+	if likes == 0 || dislikes == 0 {
+		return 0
+	}
+	magnitude := float64(likes + dislikes)
+	balance := float64(min(likes, dislikes)) / float64(max(likes, dislikes))
+	return math.Pow(magnitude, balance)
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// refreshPostScores recomputes the stored ranking scores of a post. It
+// must run after every change to the post's reactions or comments.
+func refreshPostScores(q querier, postID string) error {
+	var likes, dislikes, comments int
+	var createdAt time.Time
+	err := q.QueryRow(`
+		SELECT likes_count, dislikes_count, comments_count, created_at
+		FROM posts
+		WHERE id = ?`, postID).Scan(&likes, &dislikes, &comments, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot count activity on post %s: %w", postID, err)
+	}
+
+	_, err = q.Exec(`
+		UPDATE posts SET score = ?, hot_score = ?, controversy_score = ?
+		WHERE id = ?`,
+		likes-dislikes, hotScore(likes, dislikes, comments, createdAt),
+		controversyScore(likes, dislikes), postID)
+	if err != nil {
+		return fmt.Errorf("cannot store scores of post %s: %w", postID, err)
+	}
+	return nil
+}
+
+// refreshCommentPostScores is refreshPostScores for the post a comment
+// is on, for when moderating the comment changed the post's count.
+func refreshCommentPostScores(q querier, commentID string) error {
+	var postID string
+	if err := q.QueryRow("SELECT post_id FROM comments WHERE id = ?", commentID).Scan(&postID); err != nil {
+		return fmt.Errorf("cannot find post of comment %s: %w", commentID, err)
+	}
+	return refreshPostScores(q, postID)
+}
+
+// ScoreMissingPosts computes the ranking scores of posts created before
+// ranking was added.
+func ScoreMissingPosts(db *sql.DB) error {
+	rows, err := db.Query("SELECT id FROM posts WHERE hot_score IS NULL")
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range pending {
+		if err := refreshPostScores(db, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSort parses the sort and window query parameters. The default is
+// the newest posts first; top defaults to all time.
+func readSort(w http.ResponseWriter, r *http.Request) (sort, window string, ok bool) {
+	q := r.URL.Query()
+	sort, window = q.Get("sort"), q.Get("window")
+	if sort == "" {
+		sort = SortNew
+	}
+	if window == "" {
+		window = WindowAll
+	}
+
+	var fields []problem.FieldError
+	_, knownSort := sortOrders[sort]
+	if !knownSort {
+		fields = append(fields, problem.FieldError{Field: "sort", Code: problem.FieldInvalid,
+			Message: "sort must be one of new, top, hot or controversial"})
+	}
+	if _, known := topWindows[window]; !known {
+		fields = append(fields, problem.FieldError{Field: "window", Code: problem.FieldInvalid,
+			Message: "window must be one of day, week or all"})
+	} else if knownSort && window != WindowAll && sort != SortTop {
+		fields = append(fields, problem.FieldError{Field: "window", Code: problem.FieldInvalid,
+			Message: "window only applies to sort=top"})
+	}
+
+	if len(fields) > 0 {
+		writeValidationError(w, r, fields...)
+		return "", "", false
+	}
+	return sort, window, true
+}
@@ -4,72 +4,44 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
-	"strings"
+	"postSPA/problem"
 
 	"github.com/google/uuid"
 )
 
+// reactionSummary is a post's reaction counts as seen by one user.
+// userReaction is "like", "dislike" or "" for none.
+type reactionSummary struct {
+	likes        int
+	dislikes     int
+	userReaction string
+}
+
 func ReactToPostHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, err := getAuthenticatedUserID(db, r)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		userID, ok := requireUser(w, r, db)
+		if !ok {
 			return
 		}
-
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		postID := r.PathValue("id")
+		if !requireInteraction(w, r, db, userID) {
 			return
 		}
 
-		postID := strings.TrimPrefix(r.URL.Path, "/api/posts/")
-		postID = strings.TrimSuffix(postID, "/react")
-
-		var request struct {
-			Type string `json:"type"` // "like" or "dislike"
-		}
-		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+		reactionType, ok := readReactionType(w, r)
+		if !ok {
 			return
 		}
 
-		if request.Type != "like" && request.Type != "dislike" {
-			http.Error(w, "Invalid reaction type", http.StatusBadRequest)
+		// Sending the current reaction again removes it
+		if err := toggleReaction(db, userID, postID, reactionType); err != nil {
+			writeInternalError(w, r, "error updating reaction", err)
 			return
 		}
 
-		// Check if reaction exists
-		var existingType string
-		err = db.QueryRow(`
-			SELECT type FROM reactions 
-			WHERE user_id = ? AND post_id = ? AND comment_id IS NULL`,
-			userID, postID).Scan(&existingType)
-
-		if err == nil {
-			// Reaction exists - toggle if same type, update if different
-			if existingType == request.Type {
-				// Remove reaction
-				_, err = db.Exec(`
-					DELETE FROM reactions 
-					WHERE user_id = ? AND post_id = ? AND comment_id IS NULL`,
-					userID, postID)
-			} else {
-				// Update reaction
-				_, err = db.Exec(`
-					UPDATE reactions SET type = ?
-					WHERE user_id = ? AND post_id = ? AND comment_id IS NULL`,
-					request.Type, userID, postID)
-			}
-		} else if err == sql.ErrNoRows {
-			// New reaction
-			_, err = db.Exec(`
-				INSERT INTO reactions (id, user_id, post_id, type)
-				VALUES (?, ?, ?, ?)`,
-				uuid.New().String(), userID, postID, request.Type)
-		}
-
+		summary, err := reactionState(db, userID, postID)
 		if err != nil {
-			http.Error(w, "Failed to update reaction", http.StatusInternalServerError)
+			writeInternalError(w, r, "error counting reactions", err)
 			return
 		}
 
@@ -79,24 +51,118 @@ func ReactToPostHandler(db *sql.DB) http.HandlerFunc {
 			Dislikes int `json:"dislikes"`
 			UserVote int `json:"userVote"` // 1 for like, -1 for dislike, 0 for none
 		}
+		counts.Likes = summary.likes
+		counts.Dislikes = summary.dislikes
+		switch summary.userReaction {
+		case "like":
+			counts.UserVote = 1
+		case "dislike":
+			counts.UserVote = -1
+		}
+		writeJSON(w, http.StatusOK, counts)
+	}
+}
+
+// readReactionType reads {"type": "like" | "dislike"} from the body.
+func readReactionType(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var request struct {
+		Type string `json:"type"` // "like" or "dislike"
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeInvalidBody(w, r)
+		return "", false
+	}
+
+	if request.Type != "like" && request.Type != "dislike" {
+		writeValidationError(w, r, problem.FieldError{Field: "type", Code: problem.FieldInvalid,
+			Message: `Reaction type must be "like" or "dislike"`})
+		return "", false
+	}
+	return request.Type, true
+}
+
+// setReaction makes reactionType the user's reaction to a post, or
+// removes the reaction if reactionType is "", and updates the post's
+// ranking scores.
+func setReaction(db *sql.DB, userID, postID, reactionType string) error {
+	return inReactionTx(db, postID, func(tx *sql.Tx) error {
+		return writeReaction(tx, userID, postID, reactionType)
+	})
+}
+
+// toggleReaction removes the user's reaction to a post if it is already
+// reactionType, and otherwise sets it. The check and the write happen
+// in one transaction, so concurrent clicks can't both insert.
+func toggleReaction(db *sql.DB, userID, postID, reactionType string) error {
+	return inReactionTx(db, postID, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`
+			DELETE FROM reactions
+			WHERE user_id = ? AND post_id = ? AND comment_id IS NULL AND type = ?`,
+			userID, postID, reactionType)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		return writeReaction(tx, userID, postID, reactionType)
+	})
+}
 
-		db.QueryRow(`
-			SELECT COUNT(*) FROM reactions 
-			WHERE post_id = ? AND type = 'like' AND comment_id IS NULL`, postID).
-			Scan(&counts.Likes)
+// inReactionTx runs write and then refreshes the post's ranking scores,
+// committing both together. The first statement of write takes SQLite's
+// write lock, so a concurrent reaction waits instead of interleaving.
+func inReactionTx(db *sql.DB, postID string, write func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		db.QueryRow(`
-			SELECT COUNT(*) FROM reactions 
-			WHERE post_id = ? AND type = 'dislike' AND comment_id IS NULL`, postID).
-			Scan(&counts.Dislikes)
+	if err := write(tx); err != nil {
+		return err
+	}
+	if err := refreshPostScores(tx, postID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-		db.QueryRow(`
-			SELECT CASE WHEN type = 'like' THEN 1 WHEN type = 'dislike' THEN -1 ELSE 0 END
-			FROM reactions 
+// writeReaction upserts against idx_reactions_user_post, so a user has at
+// most one reaction per post however requests interleave.
+func writeReaction(q querier, userID, postID, reactionType string) error {
+	if reactionType == "" {
+		_, err := q.Exec(`
+			DELETE FROM reactions
 			WHERE user_id = ? AND post_id = ? AND comment_id IS NULL`,
-			userID, postID).Scan(&counts.UserVote)
+			userID, postID)
+		return err
+	}
+
+	_, err := q.Exec(`
+		INSERT INTO reactions (id, user_id, post_id, type)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, post_id) WHERE comment_id IS NULL
+		DO UPDATE SET type = excluded.type
+		WHERE type != excluded.type`,
+		uuid.New().String(), userID, postID, reactionType)
+	return err
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(counts)
+// reactionState counts a post's reactions and looks up the user's own.
+func reactionState(db *sql.DB, userID, postID string) (reactionSummary, error) {
+	var s reactionSummary
+	var userReaction sql.NullString
+	err := db.QueryRow(`
+		SELECT p.likes_count, p.dislikes_count,
+			(SELECT type FROM reactions
+				WHERE post_id = p.id AND user_id = ? AND comment_id IS NULL)
+		FROM posts p
+		WHERE p.id = ?`, userID, postID).
+		Scan(&s.likes, &s.dislikes, &userReaction)
+	if err == sql.ErrNoRows {
+		return s, nil
 	}
+	s.userReaction = userReaction.String
+	return s, err
 }
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"postSPA/problem"
+)
+
+// writeJSON sends a successful JSON response. Every handler responds
+// through writeJSON or one of the error helpers below, exactly once,
+// and returns straight after.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends an application/problem+json error.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	problem.Write(w, r, problem.New(status, code, detail))
+}
+
+// writeInternalError logs err with the request context and sends a
+// generic 500, so database details never reach the client.
+func writeInternalError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	slog.ErrorContext(r.Context(), msg, "err", err)
+	writeError(w, r, http.StatusInternalServerError, problem.CodeInternal, "An error occurred, try again later")
+}
+
+// writeValidationError sends a 422 listing every invalid field.
+func writeValidationError(w http.ResponseWriter, r *http.Request, fields ...problem.FieldError) {
+	problem.Write(w, r, problem.Validation(fields...))
+}
+
+func writeUnauthorized(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "You need to log in")
+}
+
+func writeInvalidBody(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "Request body is not valid JSON")
+}
+
+// requireUser returns the logged-in user's ID, or writes a 401, or a
+// 403 if their account is suspended or banned.
+func requireUser(w http.ResponseWriter, r *http.Request, db *sql.DB) (string, bool) {
+	userID, err := getAuthenticatedUserID(db, r)
+	var locked lockedOutError
+	if errors.As(err, &locked) {
+		writeError(w, r, http.StatusForbidden, problem.CodeForbidden, locked.detail)
+		return "", false
+	} else if err != nil {
+		writeUnauthorized(w, r)
+		return "", false
+	}
+	return userID, true
+}
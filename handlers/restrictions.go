@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"postSPA/problem"
+	"time"
+)
+
+// A user can mute another user, to stop seeing their posts and
+// comments, or block them, which also hides the blocker's content from
+// them and stops them commenting on or reacting to the blocker's posts.
+const (
+	RestrictionBlocked = "blocked"
+	RestrictionMuted   = "muted"
+)
+
+// RestrictedUser is a user the caller blocked or muted.
+type RestrictedUser struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// visibleAuthor is a condition that column, an author's user ID, is
+// neither blocked nor muted by the viewer and has not blocked them. It
+// takes the viewer's ID twice.
+func visibleAuthor(column string) string {
+	return column + ` NOT IN (SELECT target_id FROM user_restrictions WHERE user_id = ?)
+		AND ` + column + ` NOT IN (
+			SELECT user_id FROM user_restrictions WHERE target_id = ? AND restriction = 'blocked')`
+}
+
+// blockedBetween reports whether either user has blocked the other.
+func blockedBetween(db *sql.DB, a, b string) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_restrictions
+			WHERE restriction = 'blocked'
+				AND ((user_id = ? AND target_id = ?) OR (user_id = ? AND target_id = ?)))`,
+		a, b, b, a).Scan(&blocked)
+	return blocked, err
+}
+
+// requireInteraction stops userID from commenting on or reacting to
+// the post in the path when they can't see it, or when they and its
+// author have blocked each other.
+func requireInteraction(w http.ResponseWriter, r *http.Request, db *sql.DB, userID string) bool {
+	var authorID string
+	err := db.QueryRow("SELECT p.user_id FROM posts p WHERE p.id = ? AND "+visibleContent("p"),
+		r.PathValue("id"), userID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Post not found")
+		return false
+	} else if err != nil {
+		writeInternalError(w, r, "error loading post", err)
+		return false
+	}
+
+	blocked, err := blockedBetween(db, userID, authorID)
+	if err != nil {
+		writeInternalError(w, r, "error checking blocks", err)
+		return false
+	}
+	if blocked {
+		writeError(w, r, http.StatusForbidden, problem.CodeForbidden, "You can't interact with this user's posts")
+		return false
+	}
+	return true
+}
+
+// requireVisiblePost checks that viewerID, who may be "", can see the
+// post in the path, or writes a 404 as GetPostV2Handler does: it is
+// moderated, or one of them has blocked the other.
+func requireVisiblePost(w http.ResponseWriter, r *http.Request, db *sql.DB, viewerID string) bool {
+	var authorID string
+	err := db.QueryRow("SELECT p.user_id FROM posts p WHERE p.id = ? AND "+visibleContent("p"),
+		r.PathValue("id"), viewerID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Post not found")
+		return false
+	} else if err != nil {
+		writeInternalError(w, r, "error loading post", err)
+		return false
+	}
+	if viewerID == "" {
+		return true
+	}
+
+	blocked, err := blockedBetween(db, viewerID, authorID)
+	if err != nil {
+		writeInternalError(w, r, "error checking blocks", err)
+		return false
+	}
+	if blocked {
+		writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Post not found")
+		return false
+	}
+	return true
+}
+
+// setRestriction makes restriction userID's setting for targetID,
+// replacing the other one. Blocking also ends follows either way.
+func setRestriction(db *sql.DB, userID, targetID, restriction string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO user_restrictions (user_id, target_id, restriction)
+		VALUES (?, ?, ?)
+		ON CONFLICT (user_id, target_id)
+		DO UPDATE SET restriction = excluded.restriction, created_at = CURRENT_TIMESTAMP
+		WHERE restriction != excluded.restriction`,
+		userID, targetID, restriction)
+	if err != nil {
+		return fmt.Errorf("cannot save restriction: %w", err)
+	}
+
+	if restriction == RestrictionBlocked {
+		_, err = tx.Exec(`
+			DELETE FROM follows
+			WHERE (follower_id = ? AND followee_id = ?) OR (follower_id = ? AND followee_id = ?)`,
+			userID, targetID, targetID, userID)
+		if err != nil {
+			return fmt.Errorf("cannot remove follows: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// clearRestriction undoes restriction if userID set it on targetID.
+func clearRestriction(db *sql.DB, userID, targetID, restriction string) error {
+	_, err := db.Exec(`
+		DELETE FROM user_restrictions
+		WHERE user_id = ? AND target_id = ? AND restriction = ?`,
+		userID, targetID, restriction)
+	return err
+}
+
+// listRestrictions returns the users userID set restriction on, most
+// recent first, and how many there are in total.
+func listRestrictions(db *sql.DB, userID, restriction string, limit, offset int) ([]RestrictedUser, int, error) {
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM user_restrictions WHERE user_id = ? AND restriction = ?",
+		userID, restriction).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot count restrictions: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, u.username, ur.created_at
+		FROM user_restrictions ur
+		JOIN users u ON u.id = ur.target_id
+		WHERE ur.user_id = ? AND ur.restriction = ?
+		ORDER BY ur.created_at DESC, u.id DESC
+		LIMIT ? OFFSET ?`, userID, restriction, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list restrictions: %w", err)
+	}
+	defer rows.Close()
+
+	users := []RestrictedUser{}
+	for rows.Next() {
+		var u RestrictedUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.CreatedAt); err != nil {
+			return nil, 0, fmt.Errorf("cannot read restriction row: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot list restrictions: %w", err)
+	}
+	return users, total, nil
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"postSPA/problem"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// What can happen to an account. A suspension ends by itself at its
+// until time; a ban lasts until an admin reinstates the user.
+const (
+	AccountSuspend   = "suspend"
+	AccountBan       = "ban"
+	AccountReinstate = "reinstate"
+)
+
+const maxSuspensionReasonLength = 1000
+
+// AccountAction is one entry in a user's suspension history. Until is
+// set for suspensions only; ReportID when a moderator acted on a report.
+type AccountAction struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	ActorID   string     `json:"actor_id"`
+	Action    string     `json:"action"`
+	Reason    string     `json:"reason"`
+	Until     *time.Time `json:"until"`
+	ReportID  *string    `json:"report_id"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// standing is whether a user may use their account, from the users
+// columns in standingColumns.
+type standing struct {
+	suspendedUntil sql.NullTime
+	bannedAt       sql.NullTime
+	reason         sql.NullString
+}
+
+const standingColumns = "u.suspended_until, u.banned_at, u.suspension_reason"
+
+// lockout says why the account can't be used right now, or returns ""
+// if it can. Suspensions lapse on their own once their time has passed.
+func (s standing) lockout() string {
+	var detail string
+	switch {
+	case s.bannedAt.Valid:
+		detail = "This account is banned"
+	case s.suspendedUntil.Valid && time.Now().Before(s.suspendedUntil.Time):
+		detail = "This account is suspended until " + s.suspendedUntil.Time.UTC().Format("2006-01-02 15:04 MST")
+	default:
+		return ""
+	}
+	if s.reason.String != "" {
+		detail += ": " + s.reason.String
+	}
+	return detail
+}
+
+// lockedOutError is returned by getAuthenticatedUserID for a valid
+// session whose user has since been suspended or banned.
+type lockedOutError struct{ detail string }
+
+func (e lockedOutError) Error() string { return e.detail }
+
+// requireSuspendable refuses to suspend or ban the actor themselves, an
+// admin, who has to be demoted first, or, unless the actor is an admin,
+// another moderator.
+func requireSuspendable(w http.ResponseWriter, r *http.Request, db *sql.DB, actorID, userID string) bool {
+	if actorID == userID {
+		writeValidationError(w, r, problem.FieldError{Field: "action", Code: problem.FieldInvalid,
+			Message: "You can't suspend yourself"})
+		return false
+	}
+	var actorRole, role string
+	err := db.QueryRow("SELECT (SELECT role FROM users WHERE id = ?), (SELECT role FROM users WHERE id = ?)",
+		actorID, userID).Scan(&actorRole, &role)
+	if err != nil {
+		writeInternalError(w, r, "error loading role", err)
+		return false
+	}
+	switch {
+	case role == RoleAdmin:
+		writeError(w, r, http.StatusForbidden, problem.CodeForbidden, "Admins can't be suspended; demote them first")
+		return false
+	case role == RoleModerator && actorRole != RoleAdmin:
+		writeError(w, r, http.StatusForbidden, problem.CodeForbidden, "Only admins can suspend moderators")
+		return false
+	}
+	return true
+}
+
+// suspendUser applies a suspension, or a ban when a.Until is nil,
+// replacing whatever was in force, ends the user's sessions and records
+// the action. The caller fills in UserID, ActorID, Reason and ReportID.
+func suspendUser(tx *sql.Tx, a AccountAction) (AccountAction, error) {
+	a.Action = AccountSuspend
+	var bannedAt *time.Time
+	if a.Until == nil {
+		a.Action = AccountBan
+		now := time.Now().UTC()
+		bannedAt = &now
+	}
+	_, err := tx.Exec(`
+		UPDATE users SET suspended_until = ?, banned_at = ?, suspension_reason = ?
+		WHERE id = ?`, a.Until, bannedAt, a.Reason, a.UserID)
+	if err != nil {
+		return AccountAction{}, fmt.Errorf("cannot suspend user: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", a.UserID); err != nil {
+		return AccountAction{}, fmt.Errorf("cannot revoke sessions: %w", err)
+	}
+	return recordAccountAction(tx, a)
+}
+
+// reinstateUser lifts a ban or a suspension still in force. It reports
+// whether there was one, and records the action only then.
+func reinstateUser(tx *sql.Tx, actorID, userID string) (bool, error) {
+	var st standing
+	err := tx.QueryRow("SELECT "+standingColumns+" FROM users u WHERE u.id = ?", userID).
+		Scan(&st.suspendedUntil, &st.bannedAt, &st.reason)
+	if err != nil {
+		return false, fmt.Errorf("cannot load user: %w", err)
+	}
+	if st.lockout() == "" {
+		return false, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET suspended_until = NULL, banned_at = NULL, suspension_reason = NULL
+		WHERE id = ?`, userID)
+	if err != nil {
+		return false, fmt.Errorf("cannot reinstate user: %w", err)
+	}
+	a := AccountAction{UserID: userID, ActorID: actorID, Action: AccountReinstate}
+	if _, err := recordAccountAction(tx, a); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func recordAccountAction(tx *sql.Tx, a AccountAction) (AccountAction, error) {
+	a.ID = uuid.New().String()
+	a.CreatedAt = time.Now().UTC()
+	_, err := tx.Exec(`
+		INSERT INTO account_actions (id, user_id, actor_id, action, reason, until, report_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.UserID, a.ActorID, a.Action, a.Reason, a.Until, a.ReportID, a.CreatedAt)
+	if err != nil {
+		return AccountAction{}, fmt.Errorf("cannot record account action: %w", err)
+	}
+	return a, nil
+}
+
+// suspendAccount suspends or bans the user in the path for the reason
+// in the body. Exactly one of days and permanent must be given.
+func suspendAccount(w http.ResponseWriter, r *http.Request, db *sql.DB) (AccountAction, bool) {
+	adminID, ok := requireAdmin(w, r, db)
+	if !ok {
+		return AccountAction{}, false
+	}
+	userID, ok := lookupUser(w, r, db)
+	if !ok {
+		return AccountAction{}, false
+	}
+
+	var req struct {
+		Reason    string `json:"reason"`
+		Days      int    `json:"days"`
+		Permanent bool   `json:"permanent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeInvalidBody(w, r)
+		return AccountAction{}, false
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+
+	var fields []problem.FieldError
+	switch {
+	case req.Reason == "":
+		fields = append(fields, problem.FieldError{Field: "reason", Code: problem.FieldRequired,
+			Message: "A reason is required, and is shown to the user"})
+	case len(req.Reason) > maxSuspensionReasonLength:
+		fields = append(fields, problem.FieldError{Field: "reason", Code: problem.FieldTooLong,
+			Message: fmt.Sprintf("reason can be at most %d characters", maxSuspensionReasonLength)})
+	}
+	switch {
+	case req.Permanent && req.Days != 0:
+		fields = append(fields, problem.FieldError{Field: "days", Code: problem.FieldInvalid,
+			Message: "A permanent ban takes no days"})
+	case !req.Permanent && (req.Days < 1 || req.Days > maxSuspendDays):
+		fields = append(fields, problem.FieldError{Field: "days", Code: problem.FieldInvalid,
+			Message: fmt.Sprintf("days must be from 1 to %d, or set permanent for a ban", maxSuspendDays)})
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, r, fields...)
+		return AccountAction{}, false
+	}
+	if !requireSuspendable(w, r, db, adminID, userID) {
+		return AccountAction{}, false
+	}
+
+	a := AccountAction{UserID: userID, ActorID: adminID, Reason: req.Reason}
+	if !req.Permanent {
+		until := time.Now().UTC().AddDate(0, 0, req.Days)
+		a.Until = &until
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return AccountAction{}, false
+	}
+	defer tx.Rollback()
+	a, err = suspendUser(tx, a)
+	if err != nil {
+		writeInternalError(w, r, "error suspending user", err)
+		return AccountAction{}, false
+	}
+
+	event := auditEntry{actorID: adminID, action: AuditBan, targetType: "user", targetID: userID,
+		details: map[string]any{"reason": a.Reason}}
+	if a.Until != nil {
+		event.action = AuditSuspend
+		event.details["until"] = *a.Until
+	}
+	if err := recordAudit(tx, r, event); err != nil {
+		writeInternalError(w, r, "error recording audit event", err)
+		return AccountAction{}, false
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error suspending user", err)
+		return AccountAction{}, false
+	}
+	return a, true
+}
+
+// reinstateAccount lifts any ban or suspension on the user in the path.
+func reinstateAccount(w http.ResponseWriter, r *http.Request, db *sql.DB) bool {
+	adminID, ok := requireAdmin(w, r, db)
+	if !ok {
+		return false
+	}
+	userID, ok := lookupUser(w, r, db)
+	if !ok {
+		return false
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeInternalError(w, r, "error starting transaction", err)
+		return false
+	}
+	defer tx.Rollback()
+	reinstated, err := reinstateUser(tx, adminID, userID)
+	if err != nil {
+		writeInternalError(w, r, "error reinstating user", err)
+		return false
+	}
+	if reinstated {
+		err := recordAudit(tx, r, auditEntry{actorID: adminID, action: AuditReinstate, targetType: "user", targetID: userID})
+		if err != nil {
+			writeInternalError(w, r, "error recording audit event", err)
+			return false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeInternalError(w, r, "error reinstating user", err)
+		return false
+	}
+	return true
+}
+
+// listAccountActions returns a page of userID's suspension history,
+// newest first, and how many entries there are.
+func listAccountActions(db *sql.DB, userID string, limit, offset int) ([]AccountAction, int, error) {
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM account_actions WHERE user_id = ?", userID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("cannot count account actions: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, user_id, actor_id, action, reason, until, report_id, created_at
+		FROM account_actions
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?`, userID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot list account actions: %w", err)
+	}
+	defer rows.Close()
+
+	actions := []AccountAction{}
+	for rows.Next() {
+		var a AccountAction
+		var until sql.NullTime
+		var reportID sql.NullString
+		err := rows.Scan(&a.ID, &a.UserID, &a.ActorID, &a.Action, &a.Reason, &until, &reportID, &a.CreatedAt)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot read account action row: %w", err)
+		}
+		if until.Valid {
+			a.Until = &until.Time
+		}
+		a.ReportID = nullString(reportID)
+		actions = append(actions, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot list account actions: %w", err)
+	}
+	return actions, total, nil
+}
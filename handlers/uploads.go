@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"postSPA/problem"
+	"postSPA/storage"
+	"strings"
+)
+
+// uploadContentTypes are the file types the server writes to the store
+// (.jpeg only appears on older uploads). Uploads from before the server
+// named its files keep whatever extension the client sent, so any other
+// key is served only if its bytes sniff as one of these types.
+var uploadContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+}
+
+// UploadsHandler serves blobs from the store under /uploads/{key}, so clients
+// get the same URLs whichever backend is configured. It never lists
+// directories, and sends headers that stop browsers from treating an
+// upload as anything other than an image.
+func UploadsHandler(store storage.BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+			writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "File not found")
+			return
+		}
+
+		blob, err := store.Get(r.Context(), key)
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "File not found")
+			return
+		} else if err != nil {
+			writeInternalError(w, r, "error reading upload", err)
+			return
+		}
+		defer blob.Close()
+
+		body := bufio.NewReader(blob)
+		contentType, ok := uploadContentTypes[strings.ToLower(filepath.Ext(key))]
+		if !ok {
+			head, _ := body.Peek(512)
+			contentType = http.DetectContentType(head)
+			if contentType != "image/jpeg" && contentType != "image/png" && contentType != "image/gif" {
+				writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "File not found")
+				return
+			}
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", contentType)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Content-Disposition", `inline; filename="`+key+`"`)
+		h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		// Keys are content hashes, so a URL always maps to the same bytes
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+
+		if r.Method == http.MethodHead {
+			return
+		}
+		io.Copy(w, body)
+	}
+}
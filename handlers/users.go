@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"postSPA/problem"
+	"time"
+)
+
+// Profile is the public summary of a user's activity.
+type Profile struct {
+	ID               string    `json:"id"`
+	Username         string    `json:"username"`
+	PostsCount       int       `json:"posts_count"`
+	CommentsCount    int       `json:"comments_count"`
+	ReactionsGiven   int       `json:"reactions_given"`
+	LikesReceived    int       `json:"likes_received"`
+	DislikesReceived int       `json:"dislikes_received"`
+	FollowersCount   int       `json:"followers_count"`
+	FollowingCount   int       `json:"following_count"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// getProfile returns the profile of username, or sql.ErrNoRows. Posts,
+// comments and the reactions on them count only if viewerID, who may
+// be "", can see them in the user's listings.
+func getProfile(db *sql.DB, username, viewerID string) (Profile, error) {
+	// The same conditions as listPosts and listUserComments
+	visiblePosts, postArgs := visibleContent("p"), []any{viewerID}
+	if viewerID != "" {
+		visiblePosts += " AND " + visibleAuthor("p.user_id")
+		postArgs = append(postArgs, viewerID, viewerID)
+	}
+	visibleUserComments, commentArgs := visibleComments("c.user_id = u.id AND "+visiblePosts, postArgs, viewerID)
+
+	var args []any
+	args = append(args, postArgs...)
+	args = append(args, commentArgs...)
+	args = append(args, postArgs...)
+	args = append(args, postArgs...)
+	args = append(args, username)
+
+	var p Profile
+	err := db.QueryRow(`
+		SELECT u.id, u.username, u.created_at,
+			(SELECT COUNT(*) FROM posts p WHERE p.user_id = u.id AND `+visiblePosts+`),
+			(SELECT COUNT(*) FROM comments c JOIN posts p ON p.id = c.post_id WHERE `+visibleUserComments+`),
+			(SELECT COUNT(*) FROM reactions WHERE user_id = u.id),
+			(SELECT COALESCE(SUM(p.likes_count), 0) FROM posts p WHERE p.user_id = u.id AND `+visiblePosts+`),
+			(SELECT COALESCE(SUM(p.dislikes_count), 0) FROM posts p WHERE p.user_id = u.id AND `+visiblePosts+`),
+			(SELECT COUNT(*) FROM follows WHERE followee_id = u.id),
+			(SELECT COUNT(*) FROM follows WHERE follower_id = u.id)
+		FROM users u
+		WHERE u.username = ?`, args...).
+		Scan(&p.ID, &p.Username, &p.CreatedAt, &p.PostsCount, &p.CommentsCount,
+			&p.ReactionsGiven, &p.LikesReceived, &p.DislikesReceived,
+			&p.FollowersCount, &p.FollowingCount)
+	return p, err
+}
+
+// lookupUser resolves the {username} path parameter to a user ID.
+func lookupUser(w http.ResponseWriter, r *http.Request, db *sql.DB) (string, bool) {
+	var userID string
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", r.PathValue("username")).Scan(&userID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+		return "", false
+	} else if err != nil {
+		writeInternalError(w, r, "error loading user", err)
+		return "", false
+	}
+	return userID, true
+}
+
+// userTarget returns the caller and the user named by the {username}
+// path parameter, who must be someone else; selfDetail says why not.
+func userTarget(w http.ResponseWriter, r *http.Request, db *sql.DB, selfDetail string) (userID, targetID string, ok bool) {
+	userID, ok = requireUser(w, r, db)
+	if !ok {
+		return "", "", false
+	}
+	targetID, ok = lookupUser(w, r, db)
+	if !ok {
+		return "", "", false
+	}
+	if userID == targetID {
+		writeError(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, selfDetail)
+		return "", "", false
+	}
+	return userID, targetID, true
+}
@@ -0,0 +1,903 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"postSPA/config"
+	"postSPA/middleware"
+	"postSPA/problem"
+	"postSPA/storage"
+	"strconv"
+	"time"
+)
+
+// Version 2 of the API. Every field is snake_case, every response body
+// is an Envelope, and fields that can be empty are sent as null rather
+// than left out. The handlers share their logic with v1 and differ only
+// in how they shape the result.
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Envelope wraps every v2 response. Pagination is only present on
+// paginated lists.
+type Envelope struct {
+	Data       any         `json:"data"`
+	Meta       Meta        `json:"meta"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+}
+
+type Meta struct {
+	APIVersion string `json:"api_version"`
+	RequestID  string `json:"request_id"`
+}
+
+// Pagination describes the page a list response holds. NextOffset is
+// null on the last page.
+type Pagination struct {
+	Limit      int  `json:"limit"`
+	Offset     int  `json:"offset"`
+	Total      int  `json:"total"`
+	NextOffset *int `json:"next_offset"`
+}
+
+type page struct {
+	limit  int
+	offset int
+}
+
+func (p page) pagination(total int) *Pagination {
+	pg := &Pagination{Limit: p.limit, Offset: p.offset, Total: total}
+	if next := p.offset + p.limit; next < total {
+		pg.NextOffset = &next
+	}
+	return pg
+}
+
+// readPage parses the limit and offset query parameters.
+func readPage(w http.ResponseWriter, r *http.Request) (page, bool) {
+	p := page{limit: defaultPageSize}
+	var fields []problem.FieldError
+
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			fields = append(fields, problem.FieldError{Field: "limit", Code: problem.FieldInvalid,
+				Message: "limit must be a number from 1 to " + strconv.Itoa(maxPageSize)})
+		}
+		p.limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			fields = append(fields, problem.FieldError{Field: "offset", Code: problem.FieldInvalid,
+				Message: "offset must be a number from 0"})
+		}
+		p.offset = n
+	}
+
+	if len(fields) > 0 {
+		writeValidationError(w, r, fields...)
+		return page{}, false
+	}
+	return p, true
+}
+
+func writeEnvelope(w http.ResponseWriter, r *http.Request, status int, data any, pg *Pagination) {
+	writeJSON(w, status, Envelope{
+		Data:       data,
+		Meta:       Meta{APIVersion: "2", RequestID: middleware.RequestIDFrom(r.Context())},
+		Pagination: pg,
+	})
+}
+
+type UserV2 struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+type SessionV2 struct {
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type PostV2 struct {
+	ID               string   `json:"id"`
+	UserID           string   `json:"user_id"`
+	Username         string   `json:"username"`
+	Content          string   `json:"content"`
+	ContentHTML      string   `json:"content_html"`
+	Media            []Media  `json:"media"`
+	Categories       []string `json:"categories"`
+	LikesCount       int      `json:"likes_count"`
+	DislikesCount    int      `json:"dislikes_count"`
+	CommentsCount    int      `json:"comments_count"`
+	UserReaction     *string  `json:"user_reaction"`
+	ModerationNotice *string  `json:"moderation_notice"`
+	// Only in the response to creating or editing the post
+	ContentChecks []problem.CheckResult `json:"content_checks,omitempty"`
+	CreatedAt     time.Time             `json:"created_at"`
+}
+
+type CommentV2 struct {
+	ID               string  `json:"id"`
+	PostID           string  `json:"post_id"`
+	UserID           string  `json:"user_id"`
+	Username         string  `json:"username"`
+	Content          string  `json:"content"`
+	ModerationNotice *string `json:"moderation_notice"`
+	// Only in the response to creating the comment
+	ContentChecks []problem.CheckResult `json:"content_checks,omitempty"`
+	CreatedAt     time.Time             `json:"created_at"`
+}
+
+// ReactionV2 is a post's reaction counts. UserReaction is "like",
+// "dislike" or null.
+type ReactionV2 struct {
+	LikesCount    int     `json:"likes_count"`
+	DislikesCount int     `json:"dislikes_count"`
+	UserReaction  *string `json:"user_reaction"`
+}
+
+func postV2(p Post) PostV2 {
+	return PostV2{
+		ID:               p.ID,
+		UserID:           p.UserID,
+		Username:         p.Username,
+		Content:          p.Content,
+		ContentHTML:      p.ContentHTML,
+		Media:            p.Media,
+		Categories:       p.Categories,
+		LikesCount:       p.LikesCount,
+		DislikesCount:    p.DislikesCount,
+		CommentsCount:    p.CommentsCount,
+		UserReaction:     p.UserReaction,
+		ModerationNotice: p.ModerationNotice,
+		ContentChecks:    p.ContentChecks,
+		CreatedAt:        p.CreatedAt,
+	}
+}
+
+func postsV2(posts []Post) []PostV2 {
+	out := make([]PostV2, len(posts))
+	for i, p := range posts {
+		out[i] = postV2(p)
+	}
+	return out
+}
+
+func commentV2(c Comment) CommentV2 {
+	return CommentV2{
+		ID:               c.ID,
+		PostID:           c.PostID,
+		UserID:           c.UserID,
+		Username:         c.Username,
+		Content:          c.Content,
+		ModerationNotice: c.ModerationNotice,
+		ContentChecks:    c.ContentChecks,
+		CreatedAt:        c.CreatedAt,
+	}
+}
+
+func reactionV2(s reactionSummary) ReactionV2 {
+	rv := ReactionV2{LikesCount: s.likes, DislikesCount: s.dislikes}
+	if s.userReaction != "" {
+		rv.UserReaction = &s.userReaction
+	}
+	return rv
+}
+
+// RegisterV2Handler serves POST /api/v2/users.
+func RegisterV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := registerUser(w, r, db)
+		if !ok {
+			return
+		}
+		writeEnvelope(w, r, http.StatusCreated, UserV2{ID: user.ID, Username: user.Username}, nil)
+	}
+}
+
+// LoginV2Handler serves POST /api/v2/sessions.
+func LoginV2Handler(db *sql.DB, cfg config.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, session, ok := startSession(w, r, db, cfg)
+		if !ok {
+			return
+		}
+		writeEnvelope(w, r, http.StatusCreated,
+			SessionV2{UserID: user.ID, Username: user.Username, Role: user.Role, ExpiresAt: session.ExpiresAt}, nil)
+	}
+}
+
+// CurrentSessionV2Handler serves GET /api/v2/sessions/current.
+func CurrentSessionV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, session, ok := currentSession(w, r, db)
+		if !ok {
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK,
+			SessionV2{UserID: user.ID, Username: user.Username, Role: user.Role, ExpiresAt: session.ExpiresAt}, nil)
+	}
+}
+
+// LogoutV2Handler serves DELETE /api/v2/sessions/current.
+func LogoutV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !endSession(w, r, db) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListPostsV2Handler serves GET /api/v2/posts.
+func ListPostsV2Handler(db *sql.DB, store storage.BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		sort, window, ok := readSort(w, r)
+		if !ok {
+			return
+		}
+		viewer := viewerID(db, r)
+		q := postQuery{sort: sort, window: window, viewerID: viewer, mutedFor: viewer,
+			limit: p.limit, offset: p.offset}
+		posts, total, err := listPosts(db, store, q)
+		if err != nil {
+			writeInternalError(w, r, "error listing posts", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, postsV2(posts), p.pagination(total))
+	}
+}
+
+// CreatePostV2Handler serves POST /api/v2/posts.
+func CreatePostV2Handler(db *sql.DB, store storage.BlobStore, limits config.Uploads, checks ContentChecks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, ok := submitPost(w, r, db, store, limits, checks)
+		if !ok {
+			return
+		}
+		writeEnvelope(w, r, http.StatusCreated, postV2(post), nil)
+	}
+}
+
+// UpdatePostV2Handler serves PATCH /api/v2/posts/{id}.
+func UpdatePostV2Handler(db *sql.DB, store storage.BlobStore, checks ContentChecks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		update, ok := submitPostEdit(w, r, db, checks)
+		if !ok {
+			return
+		}
+		post, err := getPost(db, store, update.ID)
+		if err != nil {
+			writeInternalError(w, r, "error fetching updated post", err)
+			return
+		}
+		post.ContentChecks = update.ContentChecks
+		writeEnvelope(w, r, http.StatusOK, postV2(post), nil)
+	}
+}
+
+// SetReactionV2Handler serves PUT /api/v2/posts/{id}/reaction. Unlike
+// v1 it never toggles: the body is the reaction the user wants.
+func SetReactionV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := requireUser(w, r, db)
+		if !ok {
+			return
+		}
+		if !requireInteraction(w, r, db, userID) {
+			return
+		}
+		reactionType, ok := readReactionType(w, r)
+		if !ok {
+			return
+		}
+		writeReactionV2(w, r, db, userID, reactionType)
+	}
+}
+
+// DeleteReactionV2Handler serves DELETE /api/v2/posts/{id}/reaction.
+func DeleteReactionV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := requireUser(w, r, db)
+		if !ok {
+			return
+		}
+		if !requireInteraction(w, r, db, userID) {
+			return
+		}
+		writeReactionV2(w, r, db, userID, "")
+	}
+}
+
+func writeReactionV2(w http.ResponseWriter, r *http.Request, db *sql.DB, userID, reactionType string) {
+	postID := r.PathValue("id")
+	if err := setReaction(db, userID, postID, reactionType); err != nil {
+		writeInternalError(w, r, "error updating reaction", err)
+		return
+	}
+	summary, err := reactionState(db, userID, postID)
+	if err != nil {
+		writeInternalError(w, r, "error counting reactions", err)
+		return
+	}
+	writeEnvelope(w, r, http.StatusOK, reactionV2(summary), nil)
+}
+
+// ListCommentsV2Handler serves GET /api/v2/posts/{id}/comments.
+func ListCommentsV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		viewer := viewerID(db, r)
+		if !requireVisiblePost(w, r, db, viewer) {
+			return
+		}
+		comments, total, err := listComments(db, r.PathValue("id"), viewer, p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing comments", err)
+			return
+		}
+		out := make([]CommentV2, len(comments))
+		for i, c := range comments {
+			out[i] = commentV2(c)
+		}
+		writeEnvelope(w, r, http.StatusOK, out, p.pagination(total))
+	}
+}
+
+// CreateCommentV2Handler serves POST /api/v2/posts/{id}/comments.
+func CreateCommentV2Handler(db *sql.DB, checks ContentChecks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		comment, ok := submitComment(w, r, db, checks)
+		if !ok {
+			return
+		}
+		writeEnvelope(w, r, http.StatusCreated, commentV2(comment), nil)
+	}
+}
+
+// ListCategoriesV2Handler serves GET /api/v2/categories. There are few
+// categories, so the list is not paginated.
+func ListCategoriesV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		categories, err := listCategories(db, viewerID(db, r))
+		if err != nil {
+			writeInternalError(w, r, "error listing categories", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, categories, nil)
+	}
+}
+
+// SubscribeCategoryV2Handler serves PUT /api/v2/categories/{id}/subscription.
+func SubscribeCategoryV2Handler(db *sql.DB) http.HandlerFunc {
+	return categoryPreferenceV2(db, PreferenceSubscribed, true)
+}
+
+// UnsubscribeCategoryV2Handler serves DELETE /api/v2/categories/{id}/subscription.
+func UnsubscribeCategoryV2Handler(db *sql.DB) http.HandlerFunc {
+	return categoryPreferenceV2(db, PreferenceSubscribed, false)
+}
+
+// MuteCategoryV2Handler serves PUT /api/v2/categories/{id}/mute.
+func MuteCategoryV2Handler(db *sql.DB) http.HandlerFunc {
+	return categoryPreferenceV2(db, PreferenceMuted, true)
+}
+
+// UnmuteCategoryV2Handler serves DELETE /api/v2/categories/{id}/mute.
+func UnmuteCategoryV2Handler(db *sql.DB) http.HandlerFunc {
+	return categoryPreferenceV2(db, PreferenceMuted, false)
+}
+
+func categoryPreferenceV2(db *sql.DB, preference string, set bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !setCategoryPreference(w, r, db, preference, set) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListCategoryPostsV2Handler serves GET /api/v2/categories/{id}/posts.
+func ListCategoryPostsV2Handler(db *sql.DB, store storage.BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		sort, window, ok := readSort(w, r)
+		if !ok {
+			return
+		}
+		q := postQuery{categoryID: r.PathValue("id"), sort: sort, window: window,
+			viewerID: viewerID(db, r), limit: p.limit, offset: p.offset}
+		posts, total, err := listPosts(db, store, q)
+		if err != nil {
+			writeInternalError(w, r, "error listing category posts", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, postsV2(posts), p.pagination(total))
+	}
+}
+
+// GetPostV2Handler serves GET /api/v2/posts/{id}. Posts a moderator
+// removed, or hid from everyone but the author, are not found, nor are
+// posts by a user the caller blocked or who blocked them. Muted users'
+// posts are only left out of lists.
+func GetPostV2Handler(db *sql.DB, store storage.BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, err := getPost(db, store, r.PathValue("id"))
+		if err == sql.ErrNoRows {
+			writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Post not found")
+			return
+		} else if err != nil {
+			writeInternalError(w, r, "error loading post", err)
+			return
+		}
+
+		viewer := viewerID(db, r)
+		if !post.visibleTo(viewer) {
+			writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Post not found")
+			return
+		}
+		if viewer != "" {
+			blocked, err := blockedBetween(db, viewer, post.UserID)
+			if err != nil {
+				writeInternalError(w, r, "error checking blocks", err)
+				return
+			}
+			if blocked {
+				writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Post not found")
+				return
+			}
+		}
+
+		posts := []Post{post}
+		if err := loadUserReactions(db, viewer, posts); err != nil {
+			writeInternalError(w, r, "error loading reaction", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, postV2(posts[0]), nil)
+	}
+}
+
+// GetUserV2Handler serves GET /api/v2/users/{username}.
+func GetUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profile, err := getProfile(db, r.PathValue("username"), viewerID(db, r))
+		if err == sql.ErrNoRows {
+			writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "User not found")
+			return
+		} else if err != nil {
+			writeInternalError(w, r, "error loading profile", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, profile, nil)
+	}
+}
+
+// ListUserPostsV2Handler serves GET /api/v2/users/{username}/posts.
+func ListUserPostsV2Handler(db *sql.DB, store storage.BlobStore) http.HandlerFunc {
+	return userPostsV2(db, store, func(q *postQuery, userID string) { q.authorID = userID })
+}
+
+// ListUserLikedV2Handler serves GET /api/v2/users/{username}/liked.
+func ListUserLikedV2Handler(db *sql.DB, store storage.BlobStore) http.HandlerFunc {
+	return userPostsV2(db, store, func(q *postQuery, userID string) { q.likedBy = userID })
+}
+
+func userPostsV2(db *sql.DB, store storage.BlobStore, filter func(q *postQuery, userID string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := lookupUser(w, r, db)
+		if !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		q := postQuery{viewerID: viewerID(db, r), limit: p.limit, offset: p.offset}
+		filter(&q, userID)
+		posts, total, err := listPosts(db, store, q)
+		if err != nil {
+			writeInternalError(w, r, "error listing user posts", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, postsV2(posts), p.pagination(total))
+	}
+}
+
+// ListUserCommentsV2Handler serves GET /api/v2/users/{username}/comments.
+func ListUserCommentsV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := lookupUser(w, r, db)
+		if !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		comments, total, err := listUserComments(db, userID, viewerID(db, r), p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing user comments", err)
+			return
+		}
+		out := make([]CommentV2, len(comments))
+		for i, c := range comments {
+			out[i] = commentV2(c)
+		}
+		writeEnvelope(w, r, http.StatusOK, out, p.pagination(total))
+	}
+}
+
+// FollowUserV2Handler serves PUT /api/v2/users/{username}/follow.
+// Following someone already followed succeeds without changing anything.
+func FollowUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		followerID, followeeID, ok := userTarget(w, r, db, "You can't follow yourself")
+		if !ok {
+			return
+		}
+		blocked, err := blockedBetween(db, followerID, followeeID)
+		if err != nil {
+			writeInternalError(w, r, "error checking blocks", err)
+			return
+		}
+		if blocked {
+			writeError(w, r, http.StatusForbidden, problem.CodeForbidden, "You can't follow this user")
+			return
+		}
+		if err := follow(db, followerID, followeeID); err != nil {
+			writeInternalError(w, r, "error following user", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// UnfollowUserV2Handler serves DELETE /api/v2/users/{username}/follow.
+func UnfollowUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		followerID, followeeID, ok := userTarget(w, r, db, "You can't follow yourself")
+		if !ok {
+			return
+		}
+		if err := unfollow(db, followerID, followeeID); err != nil {
+			writeInternalError(w, r, "error unfollowing user", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListFollowersV2Handler serves GET /api/v2/users/{username}/followers.
+func ListFollowersV2Handler(db *sql.DB) http.HandlerFunc {
+	return followsV2(db, listFollowers)
+}
+
+// ListFollowingV2Handler serves GET /api/v2/users/{username}/following.
+func ListFollowingV2Handler(db *sql.DB) http.HandlerFunc {
+	return followsV2(db, listFollowing)
+}
+
+func followsV2(db *sql.DB, list func(db *sql.DB, userID string, limit, offset int) ([]Follow, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := lookupUser(w, r, db)
+		if !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		follows, total, err := list(db, userID, p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing follows", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, follows, p.pagination(total))
+	}
+}
+
+// FollowingFeedV2Handler serves GET /api/v2/feed/following: posts by the
+// users the caller follows and in the categories they subscribe to, in
+// one query however many that is. Muted categories stay out.
+func FollowingFeedV2Handler(db *sql.DB, store storage.BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := requireUser(w, r, db)
+		if !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		sort, window, ok := readSort(w, r)
+		if !ok {
+			return
+		}
+		q := postQuery{feedFor: userID, mutedFor: userID, sort: sort, window: window,
+			viewerID: userID, limit: p.limit, offset: p.offset}
+		posts, total, err := listPosts(db, store, q)
+		if err != nil {
+			writeInternalError(w, r, "error listing feed", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, postsV2(posts), p.pagination(total))
+	}
+}
+
+// BlockUserV2Handler serves PUT /api/v2/users/{username}/block. It
+// replaces a mute and ends follows in both directions.
+func BlockUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return restrictionV2(db, RestrictionBlocked, true)
+}
+
+// UnblockUserV2Handler serves DELETE /api/v2/users/{username}/block.
+func UnblockUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return restrictionV2(db, RestrictionBlocked, false)
+}
+
+// MuteUserV2Handler serves PUT /api/v2/users/{username}/mute. It
+// replaces a block.
+func MuteUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return restrictionV2(db, RestrictionMuted, true)
+}
+
+// UnmuteUserV2Handler serves DELETE /api/v2/users/{username}/mute.
+func UnmuteUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return restrictionV2(db, RestrictionMuted, false)
+}
+
+func restrictionV2(db *sql.DB, restriction string, set bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, targetID, ok := userTarget(w, r, db, "You can't block or mute yourself")
+		if !ok {
+			return
+		}
+		var err error
+		if set {
+			err = setRestriction(db, userID, targetID, restriction)
+		} else {
+			err = clearRestriction(db, userID, targetID, restriction)
+		}
+		if err != nil {
+			writeInternalError(w, r, "error saving restriction", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListBlocksV2Handler serves GET /api/v2/blocks, the users the caller
+// blocked.
+func ListBlocksV2Handler(db *sql.DB) http.HandlerFunc {
+	return restrictionsV2(db, RestrictionBlocked)
+}
+
+// ListMutesV2Handler serves GET /api/v2/mutes, the users the caller
+// muted.
+func ListMutesV2Handler(db *sql.DB) http.HandlerFunc {
+	return restrictionsV2(db, RestrictionMuted)
+}
+
+func restrictionsV2(db *sql.DB, restriction string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := requireUser(w, r, db)
+		if !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		users, total, err := listRestrictions(db, userID, restriction, p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing restrictions", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, users, p.pagination(total))
+	}
+}
+
+// CreateReportV2Handler serves POST /api/v2/reports.
+func CreateReportV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, ok := submitReport(w, r, db)
+		if !ok {
+			return
+		}
+		writeEnvelope(w, r, http.StatusCreated, report, nil)
+	}
+}
+
+// ListReportsV2Handler serves GET /api/v2/moderation/reports, the
+// moderation queue. status picks open (the default), actioned or
+// dismissed reports.
+func ListReportsV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireModerator(w, r, db); !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		status, ok := readReportStatus(w, r)
+		if !ok {
+			return
+		}
+		reports, total, err := listReports(db, status, p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing reports", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, reports, p.pagination(total))
+	}
+}
+
+// GetReportV2Handler serves GET /api/v2/moderation/reports/{id}.
+func GetReportV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireModerator(w, r, db); !ok {
+			return
+		}
+		report, err := getReport(db, r.PathValue("id"))
+		if err == sql.ErrNoRows {
+			writeError(w, r, http.StatusNotFound, problem.CodeNotFound, "Report not found")
+			return
+		} else if err != nil {
+			writeInternalError(w, r, "error loading report", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, report, nil)
+	}
+}
+
+// ResolveReportV2Handler serves POST /api/v2/moderation/reports/{id}/resolution.
+func ResolveReportV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, ok := resolveReport(w, r, db)
+		if !ok {
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, report, nil)
+	}
+}
+
+// ListHoldsV2Handler serves GET /api/v2/moderation/holds, the posts and
+// comments content checks held for a moderator, oldest first.
+func ListHoldsV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireModerator(w, r, db); !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		holds, total, err := listHolds(db, p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing holds", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, holds, p.pagination(total))
+	}
+}
+
+// ResolveHoldV2Handler serves POST /api/v2/moderation/holds/{id}/resolution.
+func ResolveHoldV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !resolveHold(w, r, db) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListWarningsV2Handler serves GET /api/v2/warnings, the warnings
+// moderators sent the caller.
+func ListWarningsV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := requireUser(w, r, db)
+		if !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		warnings, total, err := listWarnings(db, userID, p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing warnings", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, warnings, p.pagination(total))
+	}
+}
+
+// SuspendUserV2Handler serves PUT /api/v2/admin/users/{username}/suspension,
+// which suspends the user for a number of days or bans them.
+func SuspendUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action, ok := suspendAccount(w, r, db)
+		if !ok {
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, action, nil)
+	}
+}
+
+// ReinstateUserV2Handler serves DELETE /api/v2/admin/users/{username}/suspension.
+func ReinstateUserV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !reinstateAccount(w, r, db) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListSuspensionsV2Handler serves GET /api/v2/admin/users/{username}/suspensions,
+// the user's suspension history.
+func ListSuspensionsV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, db); !ok {
+			return
+		}
+		userID, ok := lookupUser(w, r, db)
+		if !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		actions, total, err := listAccountActions(db, userID, p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing suspensions", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, actions, p.pagination(total))
+	}
+}
+
+// ListAuditEventsV2Handler serves GET /api/v2/admin/audit-events, the
+// audit log newest first, filtered by actor_id, action, target_type,
+// target_id, since and until.
+func ListAuditEventsV2Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, db); !ok {
+			return
+		}
+		p, ok := readPage(w, r)
+		if !ok {
+			return
+		}
+		filter, ok := readAuditFilter(w, r)
+		if !ok {
+			return
+		}
+		events, total, err := listAuditEvents(db, filter, p.limit, p.offset)
+		if err != nil {
+			writeInternalError(w, r, "error listing audit events", err)
+			return
+		}
+		writeEnvelope(w, r, http.StatusOK, events, p.pagination(total))
+	}
+}
@@ -1,19 +1,52 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
-	"net/http"
+	"log/slog"
+	"os"
+	"os/signal"
+	"postSPA/config"
 	"postSPA/db"
 	"postSPA/handlers"
-	"strings"
+	"postSPA/middleware"
+	"sync"
+	"syscall"
 )
 
 func main() {
-	// Open or create database, and initialize schema
-	sqlitePath := "app.db"
-	schemaFile := "schema/schema.sql"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-uploads":
+			migrateUploads(os.Args[2:])
+			return
+		case "gc-uploads":
+			gcUploads(os.Args[2:])
+			return
+		case "recount":
+			recount(os.Args[2:])
+			return
+		case "set-role":
+			setRole(os.Args[2:])
+			return
+		case "verify-audit":
+			verifyAudit(os.Args[2:])
+			return
+		}
+	}
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// JSON logs; the log package is routed through the same handler
+	logger := slog.New(middleware.ContextHandler{Handler: slog.NewJSONHandler(os.Stdout, nil)})
+	slog.SetDefault(logger)
 
-	initDbErr := db.InitDB(sqlitePath, schemaFile)
+	// Open or create database, and initialize schema
+	initDbErr := db.InitDB(cfg.Database)
 	if initDbErr != nil {
 		log.Fatalf("DB init failed: %v", initDbErr)
 	}
@@ -25,48 +58,43 @@ func main() {
 	}
 	log.Println("✅ Categories seeded")
 
-	// Auth handlers
-	http.HandleFunc("/api/register", handlers.RegisterHandler(db.Db))
-	http.HandleFunc("/api/login", handlers.LoginHandler(db.Db))
-	http.HandleFunc("/api/logout", handlers.LogoutHandler(db.Db))
-	http.HandleFunc("/api/check-auth", handlers.AuthCheckHandler(db.Db))
-	http.HandleFunc("/api/posts", handlers.ListPostsHandler(db.Db))
-	http.HandleFunc("/api/posts/create", handlers.CreatePostHandler(db.Db))
-	http.HandleFunc("/api/categories/", func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-		switch {
-		case path == "/api/categories" || path == "/api/categories/":
-			handlers.ListCategoriesHandler(db.Db)(w, r)
-		case strings.HasSuffix(path, "/posts"):
-			handlers.GetCategoryPostsHandler(db.Db)(w, r)
-		default:
-			http.NotFound(w, r)
-		}
-	})
-	http.HandleFunc("/api/posts/", func(w http.ResponseWriter, r *http.Request) {
-		switch {
-		case strings.HasSuffix(r.URL.Path, "/react"):
-			handlers.ReactToPostHandler(db.Db)(w, r)
-		case strings.HasSuffix(r.URL.Path, "/comments"):
-			if r.Method == http.MethodPost {
-				handlers.CreateCommentHandler(db.Db)(w, r)
-			} else {
-				handlers.GetCommentsHandler(db.Db)(w, r)
-			}
-		default:
-			http.NotFound(w, r)
-		}
-	})
+	if err := handlers.ScoreMissingPosts(db.Db); err != nil {
+		log.Fatalf("Failed to score posts: %v", err)
+	}
+
+	if err := handlers.RenderMissingContent(db.Db); err != nil {
+		log.Fatalf("Failed to render post content: %v", err)
+	}
+
+	store, err := newBlobStore(context.Background(), cfg.Uploads, cfg.Uploads.Backend)
+	if err != nil {
+		log.Fatalf("Failed to open upload storage: %v", err)
+	}
+
+	// Cancelled on SIGINT/SIGTERM, which stops the server and every
+	// background job
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var background sync.WaitGroup
+
+	// Remove uploads that no post references in the background
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		handlers.RunUploadGC(ctx, db.Db, store, cfg.Uploads.GCInterval, cfg.Uploads.GCGrace)
+	}()
 
-	// Serve frontend (JS modules, HTML)
-	http.Handle("/", http.FileServer(http.Dir("./frontend")))
+	srv := newServer(cfg.Server, newRouter(db.Db, store, cfg, logger))
+	log.Printf("Server started on %s", cfg.Server.Addr)
+	serveErr := serve(ctx, srv, cfg.Server.ShutdownTimeout)
 
-	// Serve uploaded images
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("./static/uploads"))))
+	// Stop background jobs before the deferred db.Db.Close runs
+	stop()
+	background.Wait()
 
-	log.Println("Server started on http://localhost:8080")
-	serveErr := http.ListenAndServe(":8080", nil)
 	if serveErr != nil {
-		log.Fatal(serveErr)
+		db.Db.Close()
+		log.Fatalf("Server stopped with error: %v", serveErr)
 	}
+	log.Println("✅ Server stopped cleanly")
 }
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deprecated marks responses as coming from an endpoint deprecated since
+// the given time (RFC 9745) and, if successor is set, links to the
+// endpoint that replaces it. Wildcards such as {id} in successor are
+// filled in from the request's path values.
+func Deprecated(since time.Time, successor string) Middleware {
+	deprecation := "@" + strconv.FormatInt(since.Unix(), 10)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", deprecation)
+			if successor != "" {
+				w.Header().Add("Link", "<"+expandPath(successor, r)+`>; rel="successor-version"`)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func expandPath(pattern string, r *http.Request) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(pattern, '{')
+		end := strings.IndexByte(pattern, '}')
+		if start < 0 || end < start {
+			b.WriteString(pattern)
+			return b.String()
+		}
+		b.WriteString(pattern[:start])
+		b.WriteString(url.PathEscape(r.PathValue(pattern[start+1 : end])))
+		pattern = pattern[end+1:]
+	}
+}
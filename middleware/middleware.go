@@ -0,0 +1,18 @@
+// Package middleware holds the http.Handler wrappers applied to every
+// request: request IDs, access logs and panic recovery.
+package middleware
+
+import (
+	"net/http"
+)
+
+// Middleware wraps a handler with extra behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies middlewares so the first one listed is outermost.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recover turns a panicking handler into a 500 response instead of a
+// dropped connection, and logs the stack. The response itself is written
+// by respond, so the error format stays with the caller. http.ErrAbortHandler
+// is re-raised since it is the documented way to abort a response.
+func Recover(logger *slog.Logger, respond http.HandlerFunc) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+
+				logger.ErrorContext(r.Context(), "panic serving request",
+					"panic", p, "stack", string(debug.Stack()))
+				// If the handler already started the response this only
+				// logs a superfluous WriteHeader
+				respond(w, r)
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
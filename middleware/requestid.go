@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// Incoming IDs are reused only if they look harmless in logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestInfo is shared between the middlewares and the handlers of one
+// request. Handlers fill in what only they know, such as the user.
+type requestInfo struct {
+	id     string
+	userID string
+}
+
+type infoKey struct{}
+
+func info(ctx context.Context) *requestInfo {
+	ri, _ := ctx.Value(infoKey{}).(*requestInfo)
+	return ri
+}
+
+// RequestID takes the X-Request-ID header from the client (or a proxy in
+// front of us) or generates one, stores it in the request context and
+// echoes it in the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), infoKey{}, &requestInfo{id: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFrom returns the ID of the request ctx belongs to, or "".
+func RequestIDFrom(ctx context.Context) string {
+	if ri := info(ctx); ri != nil {
+		return ri.id
+	}
+	return ""
+}
+
+// SetUserID records the authenticated user for the access log.
+func SetUserID(ctx context.Context, userID string) {
+	if ri := info(ctx); ri != nil {
+		ri.userID = userID
+	}
+}
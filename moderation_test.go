@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"postSPA/db"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentReportResolution has several moderators resolve the
+// same report at once. Only one may act on it; the rest get a 409.
+func TestConcurrentReportResolution(t *testing.T) {
+	srv := newTestServer(t, nil)
+	post := srv.user("author", "user").createPost("Reported")
+	res := srv.user("reporter", "user").do("POST", "/api/v2/reports",
+		map[string]string{"target_type": "post", "target_id": post, "reason": "spam"})
+	if res.status != http.StatusCreated {
+		t.Fatalf("cannot report: %d %s", res.status, res.body)
+	}
+	var report struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	res.decode(t, &report)
+
+	const moderators = 6
+	var mods []*testClient
+	for i := range moderators {
+		mods = append(mods, srv.user(fmt.Sprintf("mod%d", i), "moderator"))
+	}
+
+	start := make(chan struct{})
+	statuses := make(chan int, moderators)
+	var wg sync.WaitGroup
+	for _, mod := range mods {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			res, err := mod.send("POST", "/api/v2/moderation/reports/"+report.Data.ID+"/resolution",
+				map[string]string{"action": "warn", "note": "Please stop"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			statuses <- res.status
+		}()
+	}
+	// Hold SQLite's write lock while the requests start, so they all
+	// read the report before any of them can resolve it
+	conn, err := db.Db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	close(start)
+	time.Sleep(200 * time.Millisecond)
+	conn.ExecContext(context.Background(), "ROLLBACK")
+	conn.Close()
+	wg.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != moderators-1 {
+		t.Errorf("got statuses %v, want one 200 and %d 409s", counts, moderators-1)
+	}
+
+	var warnings, resolutions int
+	err = db.Db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM user_warnings WHERE report_id = ?),
+			(SELECT COUNT(*) FROM audit_events WHERE action = 'report.resolve' AND target_id = ?)`,
+		report.Data.ID, report.Data.ID).Scan(&warnings, &resolutions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings != 1 || resolutions != 1 {
+		t.Errorf("got %d warnings and %d resolution audit events, want 1 of each", warnings, resolutions)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"postSPA/config"
+	"postSPA/handlers"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// openAPISpec is handlers/openapi.json, parsed.
+type openAPISpec struct {
+	doc       map[string]any
+	templates map[string]*regexp.Regexp // path template to its pattern
+}
+
+func loadOpenAPISpec(t *testing.T) *openAPISpec {
+	t.Helper()
+	data, err := os.ReadFile("handlers/openapi.json")
+	if err != nil {
+		t.Fatalf("cannot read spec: %v", err)
+	}
+	s := &openAPISpec{templates: map[string]*regexp.Regexp{}}
+	if err := json.Unmarshal(data, &s.doc); err != nil {
+		t.Fatalf("cannot parse spec: %v", err)
+	}
+	param := regexp.MustCompile(`\\\{[^/]+\\\}`)
+	for path := range s.doc["paths"].(map[string]any) {
+		s.templates[path] = regexp.MustCompile("^" + param.ReplaceAllString(regexp.QuoteMeta(path), "[^/]+") + "$")
+	}
+	return s
+}
+
+// operations lists every operation as "METHOD /path/{template}".
+func (s *openAPISpec) operations() []string {
+	var ops []string
+	for path, item := range s.doc["paths"].(map[string]any) {
+		for method := range item.(map[string]any) {
+			if method != "parameters" {
+				ops = append(ops, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	return ops
+}
+
+// operation finds the operation serving method and a concrete path.
+func (s *openAPISpec) operation(method, path string) (string, map[string]any) {
+	path, _, _ = strings.Cut(path, "?")
+	for template, re := range s.templates {
+		if !re.MatchString(path) {
+			continue
+		}
+		if op, ok := s.doc["paths"].(map[string]any)[template].(map[string]any)[strings.ToLower(method)]; ok {
+			return method + " " + template, op.(map[string]any)
+		}
+	}
+	return "", nil
+}
+
+// resolve follows v's $ref, if it has one.
+func (s *openAPISpec) resolve(v map[string]any) map[string]any {
+	for {
+		ref, ok := v["$ref"].(string)
+		if !ok {
+			return v
+		}
+		var node any = s.doc
+		for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node = node.(map[string]any)[key]
+		}
+		v = node.(map[string]any)
+	}
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// validate checks value against the subset of JSON Schema the spec
+// uses, returning a description of each mismatch.
+func (s *openAPISpec) validate(schema map[string]any, value any, at string) []string {
+	schema = s.resolve(schema)
+	var errs []string
+	fail := func(format string, args ...any) {
+		errs = append(errs, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, value)
+		}
+		if !found {
+			fail("%v is not one of %v", value, enum)
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		fail("%v is not %v", value, c)
+	}
+
+	if typ, ok := schema["type"]; ok {
+		var types []any
+		if list, ok := typ.([]any); ok {
+			types = list
+		} else {
+			types = []any{typ}
+		}
+		matched := false
+		for _, t := range types {
+			matched = matched || hasJSONType(t.(string), value)
+		}
+		if !matched {
+			fail("%v is not of type %v", value, typ)
+			return errs
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range asSlice(schema["required"]) {
+			if _, ok := v[name.(string)]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for name, prop := range v {
+			if propSchema, ok := props[name]; ok {
+				errs = append(errs, s.validate(propSchema.(map[string]any), prop, at+"."+name)...)
+			} else if schema["additionalProperties"] == false {
+				fail("unexpected property %q", name)
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				errs = append(errs, s.validate(items, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	case string:
+		if n, ok := schema["minLength"].(float64); ok && utf8.RuneCountInString(v) < int(n) {
+			fail("%q is shorter than %v", v, n)
+		}
+		if n, ok := schema["maxLength"].(float64); ok && utf8.RuneCountInString(v) > int(n) {
+			fail("%q is longer than %v", v, n)
+		}
+		switch schema["format"] {
+		case "uuid":
+			if !uuidPattern.MatchString(v) {
+				fail("%q is not a UUID", v)
+			}
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				fail("%q is not a date-time", v)
+			}
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && v < n {
+			fail("%v is below %v", v, n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && v > n {
+			fail("%v is above %v", v, n)
+		}
+	}
+	return errs
+}
+
+func hasJSONType(typ string, value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case float64:
+		return typ == "number" || typ == "integer" && v == math.Trunc(v)
+	case string:
+		return typ == "string"
+	case []any:
+		return typ == "array"
+	case map[string]any:
+		return typ == "object"
+	}
+	return false
+}
+
+func asSlice(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
+
+// checkResponse compares a response with what the spec documents for
+// the operation serving method and path, and returns the operation.
+func (s *openAPISpec) checkResponse(t *testing.T, method, path string, res testResponse) string {
+	t.Helper()
+	name, op := s.operation(method, path)
+	if op == nil {
+		t.Errorf("%s %s: no operation in the spec", method, path)
+		return ""
+	}
+	documented, ok := op["responses"].(map[string]any)[strconv.Itoa(res.status)]
+	if !ok {
+		t.Errorf("%s %s: status %d isn't documented for %s: %s", method, path, res.status, name, res.body)
+		return name
+	}
+	response := s.resolve(documented.(map[string]any))
+
+	content, ok := response["content"].(map[string]any)
+	if !ok {
+		if len(res.body) > 0 {
+			t.Errorf("%s %s: %d should have no body, got %s", method, path, res.status, res.body)
+		}
+		return name
+	}
+	mediaType, _, err := mime.ParseMediaType(res.header.Get("Content-Type"))
+	if err != nil {
+		t.Errorf("%s %s: bad Content-Type %q", method, path, res.header.Get("Content-Type"))
+		return name
+	}
+	media, ok := content[mediaType].(map[string]any)
+	if !ok {
+		t.Errorf("%s %s: Content-Type %s isn't documented for %d", method, path, mediaType, res.status)
+		return name
+	}
+	if mediaType != "application/json" && mediaType != "application/problem+json" {
+		return name
+	}
+
+	var body any
+	if err := json.Unmarshal(res.body, &body); err != nil {
+		t.Errorf("%s %s: body isn't JSON: %s", method, path, res.body)
+		return name
+	}
+	for _, e := range s.validate(media["schema"].(map[string]any), body, "body") {
+		t.Errorf("%s %s (%d): %s", method, path, res.status, e)
+	}
+	if mediaType == "application/problem+json" {
+		p, _ := body.(map[string]any)
+		if p["status"] != float64(res.status) {
+			t.Errorf("%s %s: problem status %v, response status %d", method, path, p["status"], res.status)
+		}
+		if id, _ := p["request_id"].(string); id == "" || id != res.header.Get("X-Request-ID") {
+			t.Errorf("%s %s: problem request_id %q doesn't match X-Request-ID %q",
+				method, path, id, res.header.Get("X-Request-ID"))
+		}
+		if p["instance"] != strings.SplitN(path, "?", 2)[0] {
+			t.Errorf("%s %s: problem instance %v", method, path, p["instance"])
+		}
+	}
+	return name
+}
+
+// TestOpenAPIContract calls every operation in openapi.json through the
+// router and checks each response's status, Content-Type and body
+// against the spec, errors included.
+func TestOpenAPIContract(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	srv := newTestServer(t, func(cfg *config.Config) {
+		cfg.Content.BannedWords = []config.BannedWord{{Word: "heldword", Mode: handlers.VerdictModerate}}
+		cfg.Content.NewAccountAge = 0
+	})
+	anon := srv.anonymous()
+	alice := srv.user("alice", "user")
+	bob := srv.user("bob", "user")
+	srv.user("carol", "user")
+	mod := srv.user("mod", "moderator")
+	admin := srv.user("admin", "admin")
+
+	// Data for the operations to act on
+	var categories struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	anon.do("GET", "/api/v2/categories", nil).decode(t, &categories)
+	category := categories.Data[0].ID
+
+	var created struct {
+		Data struct {
+			ID    string `json:"id"`
+			Media []struct {
+				Variants map[string]struct {
+					URL string `json:"url"`
+				} `json:"variants"`
+			} `json:"media"`
+		} `json:"data"`
+	}
+	res := alice.do("POST", "/api/v2/posts", postForm(t, "A post with a picture", []string{category}, true))
+	if res.status != http.StatusCreated {
+		t.Fatalf("cannot create post: %d %s", res.status, res.body)
+	}
+	res.decode(t, &created)
+	post := created.Data.ID
+	upload := created.Data.Media[0].Variants["original"].URL
+
+	var bobUser struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	anon.do("GET", "/api/v2/users/bob", nil).decode(t, &bobUser)
+
+	var report struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	res = bob.do("POST", "/api/v2/reports", map[string]string{"target_type": "post", "target_id": post, "reason": "spam"})
+	if res.status != http.StatusCreated {
+		t.Fatalf("cannot report post: %d %s", res.status, res.body)
+	}
+	res.decode(t, &report)
+
+	bob.createPost("This one has a heldword in it")
+	var holds struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	mod.do("GET", "/api/v2/moderation/holds", nil).decode(t, &holds)
+	if len(holds.Data) != 1 {
+		t.Fatalf("want 1 hold, got %d", len(holds.Data))
+	}
+	hold := holds.Data[0].ID
+
+	// Sessions that log out, so the users above stay logged in
+	v1Session, v2Session := srv.anonymous(), srv.anonymous()
+	creds := map[string]string{"username": "alice", "password": "password123"}
+	missing := "00000000-0000-4000-8000-000000000000"
+
+	type call struct {
+		client *testClient
+		method string
+		path   string
+		body   any
+		status int
+	}
+	calls := []call{
+		{anon, "GET", "/api/openapi.json", nil, 200},
+		{anon, "GET", upload, nil, 200},
+		{anon, "GET", "/uploads/missing.png", nil, 404},
+	}
+	for _, prefix := range []string{"/api", "/api/v1"} {
+		calls = append(calls,
+			call{anon, "POST", prefix + "/register", map[string]string{"username": "new" + strings.ReplaceAll(prefix, "/", ""), "password": "password123"}, 201},
+			call{anon, "POST", prefix + "/register", creds, 409},
+			call{anon, "POST", prefix + "/register", map[string]string{"username": "", "password": ""}, 422},
+			call{anon, "POST", prefix + "/register", raw("application/json", "{"), 400},
+			call{v1Session, "POST", prefix + "/login", creds, 200},
+			call{anon, "POST", prefix + "/login", map[string]string{"username": "alice", "password": "wrong"}, 401},
+			call{v1Session, "GET", prefix + "/check-auth", nil, 200},
+			call{v1Session, "POST", prefix + "/logout", nil, 200},
+			call{v1Session, "GET", prefix + "/check-auth", nil, 401},
+			call{anon, "GET", prefix + "/posts", nil, 200},
+			call{alice, "POST", prefix + "/posts/create", postForm(t, "Created through "+prefix, []string{category}, false), 201},
+			call{anon, "POST", prefix + "/posts/create", postForm(t, "Anonymous", nil, false), 401},
+			call{alice, "POST", prefix + "/posts/create", raw("text/plain", "Hello"), 415},
+			call{alice, "POST", prefix + "/posts/" + post + "/edit", map[string]string{"content": "Edited through " + prefix}, 200},
+			call{bob, "POST", prefix + "/posts/" + post + "/edit", map[string]string{"content": "Not mine"}, 403},
+			call{bob, "POST", prefix + "/posts/" + post + "/react", map[string]string{"type": "like"}, 200},
+			call{bob, "POST", prefix + "/posts/" + post + "/react", map[string]string{"type": "love"}, 422},
+			call{bob, "POST", prefix + "/posts/" + missing + "/react", map[string]string{"type": "like"}, 404},
+			call{anon, "GET", prefix + "/posts/" + post + "/comments", nil, 200},
+			call{anon, "GET", prefix + "/posts/not-a-uuid/comments", nil, 400},
+			call{bob, "POST", prefix + "/posts/" + post + "/comments", map[string]string{"content": "Comment through " + prefix}, 201},
+			call{bob, "POST", prefix + "/posts/" + missing + "/comments", map[string]string{"content": "Nowhere"}, 404},
+			call{anon, "GET", prefix + "/categories", nil, 200},
+			call{anon, "GET", prefix + "/categories/" + category + "/posts", nil, 200},
+		)
+	}
+	calls = append(calls,
+		// Sessions
+		call{anon, "POST", "/api/v2/users", map[string]string{"username": "dave", "password": "password123"}, 201},
+		call{anon, "POST", "/api/v2/users", creds, 409},
+		call{anon, "POST", "/api/v2/users", map[string]string{"username": "", "password": ""}, 422},
+		call{anon, "POST", "/api/v2/users", raw("application/json", "{"), 400},
+		call{v2Session, "POST", "/api/v2/sessions", creds, 201},
+		call{anon, "POST", "/api/v2/sessions", map[string]string{"username": "alice", "password": "wrong"}, 401},
+		call{v2Session, "GET", "/api/v2/sessions/current", nil, 200},
+		call{v2Session, "DELETE", "/api/v2/sessions/current", nil, 204},
+		call{v2Session, "GET", "/api/v2/sessions/current", nil, 401},
+
+		// Posts
+		call{anon, "GET", "/api/v2/posts", nil, 200},
+		call{anon, "GET", "/api/v2/posts?limit=0", nil, 422},
+		call{alice, "POST", "/api/v2/posts", postForm(t, "Another picture", []string{category}, true), 201},
+		call{alice, "POST", "/api/v2/posts", map[string]string{"content": "Plain text"}, 201},
+		call{anon, "POST", "/api/v2/posts", map[string]string{"content": "Anonymous"}, 401},
+		call{alice, "POST", "/api/v2/posts", raw("text/plain", "Hello"), 415},
+		call{anon, "GET", "/api/v2/posts/" + post, nil, 200},
+		call{anon, "GET", "/api/v2/posts/not-a-uuid", nil, 400},
+		call{anon, "GET", "/api/v2/posts/" + missing, nil, 404},
+		call{alice, "PATCH", "/api/v2/posts/" + post, map[string]string{"content": "Edited through v2"}, 200},
+		call{bob, "PATCH", "/api/v2/posts/" + post, map[string]string{"content": "Not mine"}, 403},
+		call{bob, "PUT", "/api/v2/posts/" + post + "/reaction", map[string]string{"type": "dislike"}, 200},
+		call{anon, "PUT", "/api/v2/posts/" + post + "/reaction", map[string]string{"type": "like"}, 401},
+		call{bob, "DELETE", "/api/v2/posts/" + post + "/reaction", nil, 200},
+		call{bob, "DELETE", "/api/v2/posts/" + missing + "/reaction", nil, 404},
+		call{anon, "GET", "/api/v2/posts/" + post + "/comments", nil, 200},
+		call{anon, "GET", "/api/v2/posts/" + missing + "/comments", nil, 404},
+		call{bob, "POST", "/api/v2/posts/" + post + "/comments", map[string]string{"content": "Comment through v2"}, 201},
+		call{bob, "POST", "/api/v2/posts/" + post + "/comments", map[string]string{"content": ""}, 422},
+
+		// Users
+		call{anon, "GET", "/api/v2/users/alice", nil, 200},
+		call{anon, "GET", "/api/v2/users/nobody", nil, 404},
+		call{anon, "GET", "/api/v2/users/alice/posts", nil, 200},
+		call{anon, "GET", "/api/v2/users/bob/comments", nil, 200},
+		call{anon, "GET", "/api/v2/users/bob/liked", nil, 200},
+		call{bob, "PUT", "/api/v2/users/alice/follow", nil, 204},
+		call{bob, "PUT", "/api/v2/users/bob/follow", nil, 400},
+		call{anon, "GET", "/api/v2/users/alice/followers", nil, 200},
+		call{anon, "GET", "/api/v2/users/bob/following", nil, 200},
+		call{bob, "GET", "/api/v2/feed/following", nil, 200},
+		call{anon, "GET", "/api/v2/feed/following", nil, 401},
+		call{bob, "DELETE", "/api/v2/users/alice/follow", nil, 204},
+		call{bob, "PUT", "/api/v2/users/carol/block", nil, 204},
+		call{bob, "GET", "/api/v2/blocks", nil, 200},
+		call{bob, "DELETE", "/api/v2/users/carol/block", nil, 204},
+		call{bob, "PUT", "/api/v2/users/carol/mute", nil, 204},
+		call{bob, "GET", "/api/v2/mutes", nil, 200},
+		call{bob, "DELETE", "/api/v2/users/carol/mute", nil, 204},
+		call{bob, "PUT", "/api/v2/users/nobody/mute", nil, 404},
+
+		// Categories
+		call{anon, "GET", "/api/v2/categories", nil, 200},
+		call{anon, "GET", "/api/v2/categories/" + category + "/posts", nil, 200},
+		call{bob, "PUT", "/api/v2/categories/" + category + "/subscription", nil, 204},
+		call{bob, "DELETE", "/api/v2/categories/" + category + "/subscription", nil, 204},
+		call{bob, "PUT", "/api/v2/categories/" + category + "/mute", nil, 204},
+		call{bob, "DELETE", "/api/v2/categories/" + category + "/mute", nil, 204},
+		call{bob, "PUT", "/api/v2/categories/" + missing + "/mute", nil, 404},
+
+		// Reports and moderation
+		call{alice, "POST", "/api/v2/reports", map[string]string{"target_type": "user", "target_id": bobUser.Data.ID, "reason": "other"}, 201},
+		call{bob, "POST", "/api/v2/reports", map[string]string{"target_type": "post", "target_id": post, "reason": "spam"}, 409},
+		call{bob, "GET", "/api/v2/warnings", nil, 200},
+		call{mod, "GET", "/api/v2/moderation/reports", nil, 200},
+		call{bob, "GET", "/api/v2/moderation/reports", nil, 403},
+		call{mod, "GET", "/api/v2/moderation/reports/" + report.Data.ID, nil, 200},
+		call{mod, "GET", "/api/v2/moderation/reports/" + missing, nil, 404},
+		call{mod, "POST", "/api/v2/moderation/reports/" + report.Data.ID + "/resolution", map[string]string{"action": "dismiss"}, 200},
+		call{mod, "POST", "/api/v2/moderation/reports/" + report.Data.ID + "/resolution", map[string]string{"action": "dismiss"}, 409},
+		call{mod, "GET", "/api/v2/moderation/holds", nil, 200},
+		call{mod, "POST", "/api/v2/moderation/holds/" + hold + "/resolution", map[string]string{"action": "shrug"}, 422},
+		call{mod, "POST", "/api/v2/moderation/holds/" + hold + "/resolution", map[string]string{"action": "approve"}, 204},
+		call{admin, "PUT", "/api/v2/admin/users/carol/suspension", map[string]any{"reason": "Testing", "days": 1}, 200},
+		call{mod, "PUT", "/api/v2/admin/users/carol/suspension", map[string]any{"reason": "Testing", "days": 1}, 403},
+		call{admin, "GET", "/api/v2/admin/users/carol/suspensions", nil, 200},
+		call{admin, "DELETE", "/api/v2/admin/users/carol/suspension", nil, 204},
+		call{admin, "DELETE", "/api/v2/admin/users/nobody/suspension", nil, 404},
+		call{admin, "GET", "/api/v2/admin/audit-events", nil, 200},
+		call{anon, "GET", "/api/v2/admin/audit-events", nil, 401},
+	)
+
+	succeeded := map[string]bool{}
+	for _, c := range calls {
+		res := c.client.do(c.method, c.path, c.body)
+		if res.status != c.status {
+			t.Errorf("%s %s: want %d, got %d: %s", c.method, c.path, c.status, res.status, res.body)
+			continue
+		}
+		if op := spec.checkResponse(t, c.method, c.path, res); op != "" && res.status < 300 {
+			succeeded[op] = true
+		}
+	}
+	for _, op := range spec.operations() {
+		if !succeeded[op] {
+			t.Errorf("%s was never called successfully", op)
+		}
+	}
+}
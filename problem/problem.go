@@ -0,0 +1,101 @@
+// Package problem implements RFC 7807 "problem details" error responses.
+// Every API error is sent as application/problem+json with a stable,
+// machine-readable code alongside the human-readable detail.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"postSPA/middleware"
+)
+
+const ContentType = "application/problem+json"
+
+// Machine-readable error codes. Clients should branch on these rather
+// than on detail text.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeValidation       = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodePayloadTooLarge  = "payload_too_large"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeContentRejected  = "content_rejected"
+	CodeInternal         = "internal_error"
+)
+
+// Problem is the response body. Type is always "about:blank", so Title
+// is the HTTP status text; Code identifies the specific error.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	// The content checks run on a content_rejected submission
+	Checks []CheckResult `json:"checks,omitempty"`
+}
+
+// FieldError describes one invalid input field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// CheckResult is what one automated content check made of a post or
+// comment. Verdict is allow, mask, moderate or block; Reason is empty
+// for allow.
+type CheckResult struct {
+	Check   string `json:"check"`
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+// Field error codes
+const (
+	FieldRequired = "required"
+	FieldTooLong  = "too_long"
+	FieldInvalid  = "invalid"
+	FieldTooLarge = "too_large"
+	FieldTooMany  = "too_many"
+)
+
+func New(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Validation builds a 422 listing every invalid field.
+func Validation(fields ...FieldError) *Problem {
+	p := New(http.StatusUnprocessableEntity, CodeValidation, "One or more fields are invalid")
+	p.Errors = fields
+	return p
+}
+
+func (p *Problem) Error() string {
+	return p.Detail
+}
+
+// Write sends p as the response, filling in the request path and ID.
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	body := *p
+	body.Instance = r.URL.Path
+	body.RequestID = middleware.RequestIDFrom(r.Context())
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(body.Status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"postSPA/db"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentReactions has several users toggle, set and clear their
+// reaction to one post at the same time, through both API versions.
+// Every request must succeed, each user must end with at most one
+// reaction, and the post's counts must match the reaction rows.
+func TestConcurrentReactions(t *testing.T) {
+	srv := newTestServer(t, nil)
+	post := srv.user("author", "user").createPost("React to this")
+
+	const users, rounds = 8, 12
+	var clients []*testClient
+	for i := range users {
+		clients = append(clients, srv.user(fmt.Sprintf("reactor%d", i), "user"))
+	}
+
+	type request struct {
+		method, path string
+		body         any
+	}
+	toggle := "/api/posts/" + post + "/react"
+	reaction := "/api/v2/posts/" + post + "/reaction"
+	requests := []request{
+		{"POST", toggle, map[string]string{"type": "like"}},
+		{"PUT", reaction, map[string]string{"type": "dislike"}},
+		{"POST", toggle, map[string]string{"type": "dislike"}},
+		{"PUT", reaction, map[string]string{"type": "like"}},
+		{"DELETE", reaction, nil},
+		{"POST", toggle, map[string]string{"type": "like"}},
+	}
+
+	start := make(chan struct{})
+	failures := make(chan string, users*rounds*2)
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		// Two goroutines per user, so a user's own requests race too
+		for g := range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for round := range rounds {
+					req := requests[(i+g+round)%len(requests)]
+					res, err := c.send(req.method, req.path, req.body)
+					if err != nil {
+						failures <- err.Error()
+					} else if res.status != http.StatusOK {
+						failures <- fmt.Sprintf("%s %s: %d %s", req.method, req.path, res.status, res.body)
+					}
+				}
+			}()
+		}
+	}
+	close(start)
+	wg.Wait()
+	close(failures)
+	for f := range failures {
+		t.Error(f)
+	}
+
+	var duplicates int
+	err := db.Db.QueryRow(`
+		SELECT COUNT(*) FROM (
+			SELECT user_id FROM reactions
+			WHERE post_id = ? AND comment_id IS NULL
+			GROUP BY user_id HAVING COUNT(*) > 1
+		)`, post).Scan(&duplicates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicates > 0 {
+		t.Errorf("%d users have more than one reaction to the post", duplicates)
+	}
+
+	var likes, dislikes, storedLikes, storedDislikes int
+	err = db.Db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM reactions WHERE post_id = p.id AND type = 'like'),
+			(SELECT COUNT(*) FROM reactions WHERE post_id = p.id AND type = 'dislike'),
+			p.likes_count, p.dislikes_count
+		FROM posts p WHERE p.id = ?`, post).Scan(&likes, &dislikes, &storedLikes, &storedDislikes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedLikes != likes || storedDislikes != dislikes {
+		t.Errorf("post counts %d likes and %d dislikes, but has %d and %d reactions",
+			storedLikes, storedDislikes, likes, dislikes)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"postSPA/config"
+	"postSPA/handlers"
+	"postSPA/middleware"
+	"postSPA/problem"
+	"postSPA/storage"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// route pairs a "METHOD /path/{param}" pattern with its handler. A
+// request whose path matches but whose method doesn't gets a 405 with
+// an Allow header from http.ServeMux.
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// legacyRoute is a v1 endpoint and the v2 endpoint that replaces it.
+// v1 is served both under /api and under /api/v1.
+type legacyRoute struct {
+	method    string
+	path      string // relative to the version prefix
+	handler   http.HandlerFunc
+	successor string
+}
+
+// v1Deprecated is when /api/v2 superseded the v1 routes.
+var v1Deprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// newRouter builds the mux from the route tables and wraps it in the
+// middleware every request goes through. Path parameters named "id"
+// must be canonical UUIDs.
+func newRouter(db *sql.DB, store storage.BlobStore, cfg *config.Config, logger *slog.Logger) http.Handler {
+	checks := handlers.NewContentChecks(cfg.Content)
+
+	v1 := []legacyRoute{
+		// Auth
+		{"POST", "/register", handlers.RegisterHandler(db), "/api/v2/users"},
+		{"POST", "/login", handlers.LoginHandler(db, cfg.Session), "/api/v2/sessions"},
+		{"POST", "/logout", handlers.LogoutHandler(db), "/api/v2/sessions/current"},
+		{"GET", "/check-auth", handlers.AuthCheckHandler(db), "/api/v2/sessions/current"},
+
+		// Posts
+		{"GET", "/posts", handlers.ListPostsHandler(db, store), "/api/v2/posts"},
+		{"POST", "/posts/create", handlers.CreatePostHandler(db, store, cfg.Uploads, checks), "/api/v2/posts"},
+		{"POST", "/posts/{id}/edit", handlers.UpdatePostHandler(db, checks), "/api/v2/posts/{id}"},
+		{"POST", "/posts/{id}/react", handlers.ReactToPostHandler(db), "/api/v2/posts/{id}/reaction"},
+		{"GET", "/posts/{id}/comments", handlers.GetCommentsHandler(db), "/api/v2/posts/{id}/comments"},
+		{"POST", "/posts/{id}/comments", handlers.CreateCommentHandler(db, checks), "/api/v2/posts/{id}/comments"},
+
+		// Categories
+		{"GET", "/categories", handlers.ListCategoriesHandler(db), "/api/v2/categories"},
+		{"GET", "/categories/{id}/posts", handlers.GetCategoryPostsHandler(db, store), "/api/v2/categories/{id}/posts"},
+	}
+
+	routes := []route{
+		// Auth
+		{"POST /api/v2/users", handlers.RegisterV2Handler(db)},
+		{"POST /api/v2/sessions", handlers.LoginV2Handler(db, cfg.Session)},
+		{"GET /api/v2/sessions/current", handlers.CurrentSessionV2Handler(db)},
+		{"DELETE /api/v2/sessions/current", handlers.LogoutV2Handler(db)},
+
+		// Posts
+		{"GET /api/v2/posts", handlers.ListPostsV2Handler(db, store)},
+		{"POST /api/v2/posts", handlers.CreatePostV2Handler(db, store, cfg.Uploads, checks)},
+		{"GET /api/v2/posts/{id}", handlers.GetPostV2Handler(db, store)},
+		{"PATCH /api/v2/posts/{id}", handlers.UpdatePostV2Handler(db, store, checks)},
+		{"PUT /api/v2/posts/{id}/reaction", handlers.SetReactionV2Handler(db)},
+		{"DELETE /api/v2/posts/{id}/reaction", handlers.DeleteReactionV2Handler(db)},
+		{"GET /api/v2/posts/{id}/comments", handlers.ListCommentsV2Handler(db)},
+		{"POST /api/v2/posts/{id}/comments", handlers.CreateCommentV2Handler(db, checks)},
+
+		// Users
+		{"GET /api/v2/users/{username}", handlers.GetUserV2Handler(db)},
+		{"GET /api/v2/users/{username}/posts", handlers.ListUserPostsV2Handler(db, store)},
+		{"GET /api/v2/users/{username}/comments", handlers.ListUserCommentsV2Handler(db)},
+		{"GET /api/v2/users/{username}/liked", handlers.ListUserLikedV2Handler(db, store)},
+		{"GET /api/v2/users/{username}/followers", handlers.ListFollowersV2Handler(db)},
+		{"GET /api/v2/users/{username}/following", handlers.ListFollowingV2Handler(db)},
+		{"PUT /api/v2/users/{username}/follow", handlers.FollowUserV2Handler(db)},
+		{"DELETE /api/v2/users/{username}/follow", handlers.UnfollowUserV2Handler(db)},
+		{"PUT /api/v2/users/{username}/block", handlers.BlockUserV2Handler(db)},
+		{"DELETE /api/v2/users/{username}/block", handlers.UnblockUserV2Handler(db)},
+		{"PUT /api/v2/users/{username}/mute", handlers.MuteUserV2Handler(db)},
+		{"DELETE /api/v2/users/{username}/mute", handlers.UnmuteUserV2Handler(db)},
+		{"GET /api/v2/blocks", handlers.ListBlocksV2Handler(db)},
+		{"GET /api/v2/mutes", handlers.ListMutesV2Handler(db)},
+
+		// Feeds
+		{"GET /api/v2/feed/following", handlers.FollowingFeedV2Handler(db, store)},
+
+		// Categories
+		{"GET /api/v2/categories", handlers.ListCategoriesV2Handler(db)},
+		{"GET /api/v2/categories/{id}/posts", handlers.ListCategoryPostsV2Handler(db, store)},
+		{"PUT /api/v2/categories/{id}/subscription", handlers.SubscribeCategoryV2Handler(db)},
+		{"DELETE /api/v2/categories/{id}/subscription", handlers.UnsubscribeCategoryV2Handler(db)},
+		{"PUT /api/v2/categories/{id}/mute", handlers.MuteCategoryV2Handler(db)},
+		{"DELETE /api/v2/categories/{id}/mute", handlers.UnmuteCategoryV2Handler(db)},
+
+		// Reports and moderation
+		{"POST /api/v2/reports", handlers.CreateReportV2Handler(db)},
+		{"GET /api/v2/warnings", handlers.ListWarningsV2Handler(db)},
+		{"GET /api/v2/moderation/reports", handlers.ListReportsV2Handler(db)},
+		{"GET /api/v2/moderation/reports/{id}", handlers.GetReportV2Handler(db)},
+		{"POST /api/v2/moderation/reports/{id}/resolution", handlers.ResolveReportV2Handler(db)},
+		{"GET /api/v2/moderation/holds", handlers.ListHoldsV2Handler(db)},
+		{"POST /api/v2/moderation/holds/{id}/resolution", handlers.ResolveHoldV2Handler(db)},
+		{"PUT /api/v2/admin/users/{username}/suspension", handlers.SuspendUserV2Handler(db)},
+		{"DELETE /api/v2/admin/users/{username}/suspension", handlers.ReinstateUserV2Handler(db)},
+		{"GET /api/v2/admin/users/{username}/suspensions", handlers.ListSuspensionsV2Handler(db)},
+		{"GET /api/v2/admin/audit-events", handlers.ListAuditEventsV2Handler(db)},
+
+		// API description
+		{"GET /api/openapi.json", handlers.OpenAPIHandler()},
+
+		// Uploaded images, from whichever backend stores them
+		{"GET /uploads/{key}", handlers.UploadsHandler(store)},
+
+		// Frontend (JS modules, HTML)
+		{frontendPattern, http.FileServer(http.Dir(cfg.Server.FrontendDir)).ServeHTTP},
+	}
+
+	for _, lr := range v1 {
+		deprecated := middleware.Deprecated(v1Deprecated, lr.successor)(lr.handler).ServeHTTP
+		for _, prefix := range []string{"/api", "/api/v1"} {
+			routes = append(routes, route{lr.method + " " + prefix + lr.path, deprecated})
+		}
+	}
+
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		h := rt.handler
+		if strings.Contains(rt.pattern, "{id}") {
+			h = requireUUID("id", h)
+		}
+		mux.HandleFunc(rt.pattern, h)
+	}
+
+	return middleware.Chain(withFallback(mux),
+		middleware.RequestID,
+		middleware.AccessLog(logger),
+		middleware.Recover(logger, func(w http.ResponseWriter, r *http.Request) {
+			problem.Write(w, r, problem.New(http.StatusInternalServerError, problem.CodeInternal,
+				"An error occurred, try again later"))
+		}),
+	)
+}
+
+// frontendPattern serves the frontend's files. It also matches GET on
+// API paths that no route handles, which withFallback answers instead.
+const frontendPattern = "GET /"
+
+// routeMethods are the methods withFallback tries when a path has no
+// route for the request's method.
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// withFallback answers requests no route handles with a problem, like
+// every other API error, rather than the mux's plain text. The mux would
+// also serve API paths to the frontend as files, and list the frontend's
+// methods in a 405, so it says itself whether the path is unknown (404)
+// or only the method (405, with the methods the path does have).
+func withFallback(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api := strings.HasPrefix(r.URL.Path, "/api/")
+		routed := func(r *http.Request) bool {
+			_, pattern := mux.Handler(r)
+			return pattern != "" && !(api && pattern == frontendPattern)
+		}
+		if routed(r) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		var allow []string
+		for _, method := range routeMethods {
+			probe := *r
+			probe.Method = method
+			if routed(&probe) {
+				allow = append(allow, method)
+			}
+		}
+		if len(allow) == 0 {
+			problem.Write(w, r, problem.New(http.StatusNotFound, problem.CodeNotFound, "No such endpoint"))
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed,
+			r.Method+" isn't supported here; use "+strings.Join(allow, ", ")))
+	})
+}
+
+// requireUUID rejects requests whose path parameter is not a UUID in
+// canonical form before they reach the handler.
+func requireUUID(param string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(r.PathValue(param))
+		if err != nil || id.String() != r.PathValue(param) {
+			problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Invalid "+param))
+			return
+		}
+		next(w, r)
+	}
+}
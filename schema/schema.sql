@@ -5,6 +5,14 @@ CREATE TABLE IF NOT EXISTS users (
     id TEXT PRIMARY KEY,
     username TEXT NOT NULL UNIQUE,
     password_hash TEXT NOT NULL,
+    -- Moderators work the report queue; admins can also do anything
+    -- moderators can
+    role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin')),
+    -- Set by a moderator or admin; the user can't log in until then,
+    -- or ever while banned_at is set. suspension_reason explains either
+    suspended_until DATETIME,
+    banned_at DATETIME,
+    suspension_reason TEXT,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -13,17 +21,82 @@ CREATE TABLE IF NOT EXISTS posts (
     id TEXT PRIMARY KEY,
     user_id TEXT NOT NULL,
     content TEXT NOT NULL,
+    content_html TEXT,
     image_path TEXT,
+    -- Ranking scores, kept up to date by the application (see
+    -- handlers/ranking.go); indexed in db/migrate.go
+    score INTEGER NOT NULL DEFAULT 0,
+    hot_score REAL,
+    controversy_score REAL NOT NULL DEFAULT 0,
+    -- Maintained by the triggers on reactions and comments
+    likes_count INTEGER NOT NULL DEFAULT 0,
+    dislikes_count INTEGER NOT NULL DEFAULT 0,
+    comments_count INTEGER NOT NULL DEFAULT 0,
+    -- Set by a moderator: hidden posts are only shown to their author,
+    -- removed ones to nobody
+    moderation TEXT CHECK (moderation IN ('hidden', 'removed')),
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+-- Stored sizes of each uploaded image (keyed by posts.image_path)
+CREATE TABLE IF NOT EXISTS image_variants (
+    image_path TEXT NOT NULL,
+    variant TEXT NOT NULL CHECK (variant IN ('original', 'medium', 'thumbnail')),
+    file_name TEXT NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    PRIMARY KEY (image_path, variant)
+);
+
+-- Post galleries, ordered by position
+CREATE TABLE IF NOT EXISTS post_media (
+    post_id TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    image_path TEXT NOT NULL,
+    alt_text TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (post_id, position),
+    FOREIGN KEY (post_id) REFERENCES posts(id)
+);
+
+-- Uploaded images, stored under the SHA-256 of their bytes. ref_count is
+-- the number of post_media rows using the image; unreferenced uploads are
+-- removed by gc-uploads once last_used_at is older than the grace period.
+CREATE TABLE IF NOT EXISTS uploads (
+    image_path TEXT PRIMARY KEY,
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER IF NOT EXISTS post_media_ref_insert
+AFTER INSERT ON post_media
+BEGIN
+    INSERT OR IGNORE INTO uploads (image_path) VALUES (NEW.image_path);
+    UPDATE uploads
+    SET ref_count = ref_count + 1, last_used_at = CURRENT_TIMESTAMP
+    WHERE image_path = NEW.image_path;
+END;
+
+CREATE TRIGGER IF NOT EXISTS post_media_ref_delete
+AFTER DELETE ON post_media
+BEGIN
+    UPDATE uploads
+    SET ref_count = ref_count - 1, last_used_at = CURRENT_TIMESTAMP
+    WHERE image_path = OLD.image_path;
+END;
+
 -- Comments
 CREATE TABLE IF NOT EXISTS comments (
     id TEXT PRIMARY KEY,
     post_id TEXT NOT NULL,
     user_id TEXT NOT NULL,
     content TEXT NOT NULL,
+    -- Maintained by the triggers on reactions
+    likes_count INTEGER NOT NULL DEFAULT 0,
+    dislikes_count INTEGER NOT NULL DEFAULT 0,
+    -- As on posts
+    moderation TEXT CHECK (moderation IN ('hidden', 'removed')),
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (post_id) REFERENCES posts(id),
     FOREIGN KEY (user_id) REFERENCES users(id)
@@ -44,6 +117,17 @@ CREATE TABLE IF NOT EXISTS post_categories (
     FOREIGN KEY (category_id) REFERENCES categories(id)
 );
 
+-- A user's subscription to or mute of a category, never both
+CREATE TABLE IF NOT EXISTS category_preferences (
+    user_id TEXT NOT NULL,
+    category_id TEXT NOT NULL,
+    preference TEXT NOT NULL CHECK (preference IN ('subscribed', 'muted')),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, category_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (category_id) REFERENCES categories(id)
+);
+
 -- Reactions (likes/dislikes for posts or comments)
 CREATE TABLE IF NOT EXISTS reactions (
     id TEXT PRIMARY KEY,
@@ -59,6 +143,8 @@ CREATE TABLE IF NOT EXISTS reactions (
         (post_id IS NOT NULL AND comment_id IS NULL) OR
         (post_id IS NULL AND comment_id IS NOT NULL)
     ),
+    -- NULLs never compare equal here; db/migrate.go adds partial unique
+    -- indexes that enforce one reaction per user and target
     UNIQUE(user_id, post_id, comment_id)
 );
 
@@ -71,6 +157,222 @@ CREATE TABLE IF NOT EXISTS sessions (
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+-- Follows (follower_id sees followee_id's posts in their feed)
+CREATE TABLE IF NOT EXISTS follows (
+    follower_id TEXT NOT NULL,
+    followee_id TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (follower_id, followee_id),
+    FOREIGN KEY (follower_id) REFERENCES users(id),
+    FOREIGN KEY (followee_id) REFERENCES users(id),
+    CHECK (follower_id != followee_id)
+);
+
+-- A user's block or mute of another user, never both
+CREATE TABLE IF NOT EXISTS user_restrictions (
+    user_id TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    restriction TEXT NOT NULL CHECK (restriction IN ('blocked', 'muted')),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, target_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (target_id) REFERENCES users(id),
+    CHECK (user_id != target_id)
+);
+
+-- Reports of abusive posts, comments or users. Resolving a report
+-- resolves every open report on the same target.
+CREATE TABLE IF NOT EXISTS reports (
+    id TEXT PRIMARY KEY,
+    reporter_id TEXT NOT NULL,
+    target_type TEXT NOT NULL CHECK (target_type IN ('post', 'comment', 'user')),
+    target_id TEXT NOT NULL,
+    reason TEXT NOT NULL CHECK (reason IN ('spam', 'harassment', 'hate', 'violence', 'sexual', 'other')),
+    note TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'actioned', 'dismissed')),
+    action TEXT CHECK (action IN ('dismiss', 'hide', 'remove', 'warn', 'suspend')),
+    resolution_note TEXT,
+    resolved_by TEXT,
+    resolved_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (reporter_id) REFERENCES users(id),
+    FOREIGN KEY (resolved_by) REFERENCES users(id)
+);
+
+-- Warnings moderators sent to users
+CREATE TABLE IF NOT EXISTS user_warnings (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    moderator_id TEXT NOT NULL,
+    report_id TEXT,
+    message TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (moderator_id) REFERENCES users(id),
+    FOREIGN KEY (report_id) REFERENCES reports(id)
+);
+
+-- Every suspension, ban and reinstatement, oldest first. Rows are
+-- never updated or deleted; users.suspended_until and banned_at hold
+-- the current state
+CREATE TABLE IF NOT EXISTS account_actions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    actor_id TEXT NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('suspend', 'ban', 'reinstate')),
+    reason TEXT NOT NULL DEFAULT '',
+    until DATETIME,
+    report_id TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (actor_id) REFERENCES users(id),
+    FOREIGN KEY (report_id) REFERENCES reports(id)
+);
+
+-- Posts and comments a content check sent to moderators. The content
+-- is hidden until a moderator approves or removes it, which deletes the
+-- hold
+CREATE TABLE IF NOT EXISTS content_holds (
+    id TEXT PRIMARY KEY,
+    target_type TEXT NOT NULL CHECK (target_type IN ('post', 'comment')),
+    target_id TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (target_type, target_id)
+);
+
+-- Security-relevant actions, one row each. seq orders the rows and hash
+-- chains them: each hash covers the row and the previous row's hash, so
+-- editing or deleting a row breaks the chain (see the verify-audit
+-- command). actor_id is NULL for actions from the command line, and has
+-- no foreign key so the log outlives the users in it
+CREATE TABLE IF NOT EXISTS audit_events (
+    seq INTEGER PRIMARY KEY,
+    actor_id TEXT,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL DEFAULT '',
+    target_id TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    details TEXT NOT NULL DEFAULT '{}',
+    created_at DATETIME NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+);
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_update
+BEFORE UPDATE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit_events is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_delete
+BEFORE DELETE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit_events is append-only');
+END;
+
 -- Add to existing reactions table
 CREATE INDEX IF NOT EXISTS idx_reactions_post_id ON reactions(post_id);
 CREATE INDEX IF NOT EXISTS idx_reactions_comment_id ON reactions(comment_id);
+
+-- Per-user listings
+CREATE INDEX IF NOT EXISTS idx_posts_user_id ON posts(user_id);
+CREATE INDEX IF NOT EXISTS idx_comments_user_id ON comments(user_id);
+CREATE INDEX IF NOT EXISTS idx_reactions_user_id ON reactions(user_id);
+CREATE INDEX IF NOT EXISTS idx_follows_follower_id ON follows(follower_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_follows_followee_id ON follows(followee_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_user_restrictions_target_id ON user_restrictions(target_id, restriction);
+CREATE INDEX IF NOT EXISTS idx_user_warnings_user_id ON user_warnings(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_account_actions_user_id ON account_actions(user_id, created_at);
+
+-- Audit log filters; every one lists newest first
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id, seq);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action, seq);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events(target_type, target_id, seq);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+
+-- The moderation queue, and one open report per reporter and target
+CREATE INDEX IF NOT EXISTS idx_reports_status ON reports(status, created_at);
+CREATE INDEX IF NOT EXISTS idx_reports_target ON reports(target_type, target_id, status);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_reports_open ON reports(reporter_id, target_type, target_id)
+    WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_content_holds_created_at ON content_holds(created_at);
+
+-- Per-category listings and counts
+CREATE INDEX IF NOT EXISTS idx_post_categories_category_id ON post_categories(category_id);
+CREATE INDEX IF NOT EXISTS idx_category_preferences_category_id ON category_preferences(category_id, preference);
+
+-- Denormalized counters. Each trigger runs in the statement's own
+-- transaction, so the counts change atomically with the rows they count.
+-- The recount command repairs them if they ever drift.
+CREATE TRIGGER IF NOT EXISTS reactions_count_insert
+AFTER INSERT ON reactions
+BEGIN
+    UPDATE posts
+    SET likes_count = likes_count + (NEW.type = 'like'),
+        dislikes_count = dislikes_count + (NEW.type = 'dislike')
+    WHERE id = NEW.post_id;
+    UPDATE comments
+    SET likes_count = likes_count + (NEW.type = 'like'),
+        dislikes_count = dislikes_count + (NEW.type = 'dislike')
+    WHERE id = NEW.comment_id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS reactions_count_delete
+AFTER DELETE ON reactions
+BEGIN
+    UPDATE posts
+    SET likes_count = likes_count - (OLD.type = 'like'),
+        dislikes_count = dislikes_count - (OLD.type = 'dislike')
+    WHERE id = OLD.post_id;
+    UPDATE comments
+    SET likes_count = likes_count - (OLD.type = 'like'),
+        dislikes_count = dislikes_count - (OLD.type = 'dislike')
+    WHERE id = OLD.comment_id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS reactions_count_update
+AFTER UPDATE OF type, post_id, comment_id ON reactions
+BEGIN
+    UPDATE posts
+    SET likes_count = likes_count - (OLD.type = 'like'),
+        dislikes_count = dislikes_count - (OLD.type = 'dislike')
+    WHERE id = OLD.post_id;
+    UPDATE comments
+    SET likes_count = likes_count - (OLD.type = 'like'),
+        dislikes_count = dislikes_count - (OLD.type = 'dislike')
+    WHERE id = OLD.comment_id;
+    UPDATE posts
+    SET likes_count = likes_count + (NEW.type = 'like'),
+        dislikes_count = dislikes_count + (NEW.type = 'dislike')
+    WHERE id = NEW.post_id;
+    UPDATE comments
+    SET likes_count = likes_count + (NEW.type = 'like'),
+        dislikes_count = dislikes_count + (NEW.type = 'dislike')
+    WHERE id = NEW.comment_id;
+END;
+
+-- comments_count counts the comments everyone can see, so a comment
+-- drops out when a moderator hides or removes it, or a content check
+-- holds it, and comes back if it is approved
+CREATE TRIGGER IF NOT EXISTS visible_comments_count_insert
+AFTER INSERT ON comments
+WHEN NEW.moderation IS NULL
+BEGIN
+    UPDATE posts SET comments_count = comments_count + 1 WHERE id = NEW.post_id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS visible_comments_count_delete
+AFTER DELETE ON comments
+WHEN OLD.moderation IS NULL
+BEGIN
+    UPDATE posts SET comments_count = comments_count - 1 WHERE id = OLD.post_id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS visible_comments_count_update
+AFTER UPDATE OF moderation, post_id ON comments
+BEGIN
+    UPDATE posts SET comments_count = comments_count - (OLD.moderation IS NULL) WHERE id = OLD.post_id;
+    UPDATE posts SET comments_count = comments_count + (NEW.moderation IS NULL) WHERE id = NEW.post_id;
+END;
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"path/filepath"
+	"postSPA/config"
+	"postSPA/db"
+	"postSPA/storage"
+	"testing"
+)
+
+// testServer runs the full router against a fresh database.
+type testServer struct {
+	*httptest.Server
+	t          *testing.T
+	uploadsDir string
+}
+
+// newTestServer starts a server on an empty database in a temporary
+// directory. configure, if not nil, adjusts the default configuration
+// first.
+func newTestServer(t *testing.T, configure func(cfg *config.Config)) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+
+	cfg := config.Default()
+	cfg.Server.FrontendDir = "frontend"
+	cfg.Database.Path = filepath.Join(dir, "test.db")
+	cfg.Uploads.Dir = filepath.Join(dir, "uploads")
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	if err := db.InitDB(cfg.Database); err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	t.Cleanup(func() { db.Db.Close() })
+	if err := db.SeedCategories(db.Db); err != nil {
+		t.Fatalf("cannot seed categories: %v", err)
+	}
+	store, err := storage.NewLocal(cfg.Uploads.Dir, "/uploads")
+	if err != nil {
+		t.Fatalf("cannot open upload store: %v", err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	srv := httptest.NewServer(newRouter(db.Db, store, &cfg, logger))
+	t.Cleanup(srv.Close)
+	return &testServer{Server: srv, t: t, uploadsDir: cfg.Uploads.Dir}
+}
+
+// testClient makes requests as one user, keeping their session cookie.
+type testClient struct {
+	srv  *testServer
+	http *http.Client
+}
+
+// anonymous returns a client without a session.
+func (s *testServer) anonymous() *testClient {
+	jar, _ := cookiejar.New(nil)
+	return &testClient{srv: s, http: &http.Client{Jar: jar}}
+}
+
+// user registers username and returns a client logged in as them. A
+// role other than "user" is granted directly in the database.
+func (s *testServer) user(username, role string) *testClient {
+	s.t.Helper()
+	c := s.anonymous()
+	creds := map[string]string{"username": username, "password": "password123"}
+	if res := c.do("POST", "/api/v2/users", creds); res.status != http.StatusCreated {
+		s.t.Fatalf("cannot register %s: %d %s", username, res.status, res.body)
+	}
+	if role != "user" {
+		if _, err := db.Db.Exec("UPDATE users SET role = ? WHERE username = ?", role, username); err != nil {
+			s.t.Fatalf("cannot make %s a %s: %v", username, role, err)
+		}
+	}
+	if res := c.do("POST", "/api/v2/sessions", creds); res.status != http.StatusCreated {
+		s.t.Fatalf("cannot log in as %s: %d %s", username, res.status, res.body)
+	}
+	return c
+}
+
+// testResponse is a response with its body read.
+type testResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// decode unmarshals the body into v, failing the test if it isn't JSON.
+func (res testResponse) decode(t *testing.T, v any) {
+	t.Helper()
+	if err := json.Unmarshal(res.body, v); err != nil {
+		t.Fatalf("cannot decode response %s: %v", res.body, err)
+	}
+}
+
+// do sends body as JSON, or as is if it is a *rawBody, and reads the
+// whole response.
+func (c *testClient) do(method, path string, body any) testResponse {
+	c.srv.t.Helper()
+	res, err := c.send(method, path, body)
+	if err != nil {
+		c.srv.t.Fatal(err)
+	}
+	return res
+}
+
+// send is do for goroutines other than the test's, which must not stop
+// the test themselves.
+func (c *testClient) send(method, path string, body any) (testResponse, error) {
+	var reader io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case *rawBody:
+		reader, contentType = &b.buf, b.contentType
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return testResponse{}, fmt.Errorf("cannot encode request body: %w", err)
+		}
+		reader, contentType = bytes.NewReader(data), "application/json"
+	}
+
+	req, err := http.NewRequest(method, c.srv.URL+path, reader)
+	if err != nil {
+		return testResponse{}, fmt.Errorf("cannot build request: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return testResponse{}, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return testResponse{}, fmt.Errorf("%s %s: cannot read body: %w", method, path, err)
+	}
+	return testResponse{status: resp.StatusCode, header: resp.Header, body: data}, nil
+}
+
+// rawBody is a request body that isn't JSON, such as a form.
+type rawBody struct {
+	buf         bytes.Buffer
+	contentType string
+}
+
+// raw builds a body of the given type.
+func raw(contentType, data string) *rawBody {
+	b := &rawBody{contentType: contentType}
+	b.buf.WriteString(data)
+	return b
+}
+
+// postForm builds a create-post form with content, the given category
+// IDs and, if withImage, a small PNG.
+func postForm(t *testing.T, content string, categories []string, withImage bool) *rawBody {
+	t.Helper()
+	b := &rawBody{}
+	w := multipart.NewWriter(&b.buf)
+	w.WriteField("content", content)
+	for _, id := range categories {
+		w.WriteField("categories", id)
+	}
+	if withImage {
+		part, err := w.CreateFormFile("image", "dot.png")
+		if err != nil {
+			t.Fatalf("cannot add image: %v", err)
+		}
+		if err := png.Encode(part, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+			t.Fatalf("cannot encode image: %v", err)
+		}
+		w.WriteField("alt", "A dot")
+	}
+	w.Close()
+	b.contentType = w.FormDataContentType()
+	return b
+}
+
+// createPost posts content as c through the v2 API and returns its ID.
+func (c *testClient) createPost(content string) string {
+	c.srv.t.Helper()
+	res := c.do("POST", "/api/v2/posts", map[string]string{"content": content})
+	if res.status != http.StatusCreated {
+		c.srv.t.Fatalf("cannot create post: %d %s", res.status, res.body)
+	}
+	var created struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	res.decode(c.srv.t, &created)
+	return created.Data.ID
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"postSPA/db"
+	"testing"
+	"time"
+)
+
+// TestExpiredSessionIsRefused checks that a session past its expiry no
+// longer authorizes requests, though the browser still sends its cookie.
+func TestExpiredSessionIsRefused(t *testing.T) {
+	srv := newTestServer(t, nil)
+	alice := srv.user("alice", "user")
+	post := alice.createPost("Before expiry")
+
+	var userID string
+	if err := db.Db.QueryRow("SELECT id FROM users WHERE username = 'alice'").Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Db.Exec("UPDATE sessions SET expires_at = ? WHERE user_id = ?", time.Now().Add(-time.Minute), userID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		body         any
+	}{
+		{"POST", "/api/v2/posts", map[string]string{"content": "After expiry"}},
+		{"PATCH", "/api/v2/posts/" + post, map[string]string{"content": "Edited after expiry"}},
+		{"PUT", "/api/v2/posts/" + post + "/reaction", map[string]string{"type": "like"}},
+		{"POST", "/api/posts/" + post + "/comments", map[string]string{"content": "Commented after expiry"}},
+		{"GET", "/api/v2/sessions/current", nil},
+	} {
+		if res := alice.do(c.method, c.path, c.body); res.status != http.StatusUnauthorized {
+			t.Errorf("%s %s with an expired session: got %d, want 401: %s", c.method, c.path, res.status, res.body)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+)
+
+// Copy copies every blob in src to dst, skipping keys dst already has.
+// It returns how many blobs were copied.
+func Copy(ctx context.Context, src BlobStore, dst BlobStore) (int, error) {
+	lister, ok := src.(Lister)
+	if !ok {
+		return 0, errors.New("source store cannot list its blobs")
+	}
+
+	blobs, err := lister.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list source: %w", err)
+	}
+
+	copied := 0
+	for _, blob := range blobs {
+		key := blob.Key
+		if existing, err := dst.Get(ctx, key); err == nil {
+			existing.Close()
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return copied, fmt.Errorf("cannot check %s: %w", key, err)
+		}
+
+		if err := copyBlob(ctx, src, dst, blob); err != nil {
+			return copied, fmt.Errorf("cannot copy %s: %w", key, err)
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+func copyBlob(ctx context.Context, src BlobStore, dst BlobStore, blob BlobInfo) error {
+	r, err := src.Get(ctx, blob.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return dst.Put(ctx, blob.Key, r, blob.Size, mime.TypeByExtension(filepath.Ext(blob.Key)))
+}
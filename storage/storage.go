@@ -0,0 +1,36 @@
+// Package storage abstracts where uploaded files are kept so several
+// server instances can share them.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by Get and Delete when the key does not exist.
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore stores uploaded files under flat keys such as
+// "4f0c...e1.jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// URL is the address clients use to fetch the blob
+	URL(key string) string
+}
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Lister is implemented by stores that can enumerate their blobs. It is
+// used by maintenance commands such as migrate-uploads and gc-uploads.
+type Lister interface {
+	List(ctx context.Context) ([]BlobInfo, error)
+}
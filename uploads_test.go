@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLegacyUploadsAreSniffed serves files stored under the name the
+// client sent, as uploads from before the server named its files were:
+// an image is served with its sniffed type, anything else is not.
+func TestLegacyUploadsAreSniffed(t *testing.T) {
+	srv := newTestServer(t, nil)
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"3f1c2e7a-legacy.jfif": img.Bytes(),
+		"3f1c2e7a-legacy":      img.Bytes(),
+		"3f1c2e7a-page.html":   []byte("<html><script>alert(1)</script></html>"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(srv.uploadsDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	anon := srv.anonymous()
+	for _, key := range []string{"3f1c2e7a-legacy.jfif", "3f1c2e7a-legacy"} {
+		res := anon.do("GET", "/uploads/"+key, nil)
+		if res.status != http.StatusOK || res.header.Get("Content-Type") != "image/png" || !bytes.Equal(res.body, img.Bytes()) {
+			t.Errorf("GET /uploads/%s: got %d %q, want the PNG", key, res.status, res.header.Get("Content-Type"))
+		}
+	}
+	if res := anon.do("GET", "/uploads/3f1c2e7a-page.html", nil); res.status != http.StatusNotFound {
+		t.Errorf("GET /uploads/3f1c2e7a-page.html: got %d, want 404", res.status)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestCountsFollowRestrictions checks that the post, comment and like
+// counts on a profile and the post counts on categories leave out what
+// the viewer's listings do once they mute the author.
+func TestCountsFollowRestrictions(t *testing.T) {
+	srv := newTestServer(t, nil)
+	author := srv.user("author", "user")
+	viewer := srv.user("viewer", "user")
+
+	var categories struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	srv.anonymous().do("GET", "/api/v2/categories", nil).decode(t, &categories)
+	category := categories.Data[0].ID
+	res := author.do("POST", "/api/v2/posts", postForm(t, "In a category", []string{category}, false))
+	if res.status != http.StatusCreated {
+		t.Fatalf("cannot create post: %d %s", res.status, res.body)
+	}
+	var post struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	res.decode(t, &post)
+	if res := author.do("POST", "/api/v2/posts/"+post.Data.ID+"/comments", map[string]string{"content": "My own comment"}); res.status != http.StatusCreated {
+		t.Fatalf("cannot comment: %d %s", res.status, res.body)
+	}
+	if res := srv.user("fan", "user").do("PUT", "/api/v2/posts/"+post.Data.ID+"/reaction", map[string]string{"type": "like"}); res.status != http.StatusOK {
+		t.Fatalf("cannot react: %d %s", res.status, res.body)
+	}
+
+	// counts returns the author's posts, comments and likes received,
+	// and the category's posts, as c sees them
+	counts := func(c *testClient) [4]int {
+		t.Helper()
+		var profile struct {
+			Data struct {
+				PostsCount    int `json:"posts_count"`
+				CommentsCount int `json:"comments_count"`
+				LikesReceived int `json:"likes_received"`
+			} `json:"data"`
+		}
+		c.do("GET", "/api/v2/users/author", nil).decode(t, &profile)
+		var cats struct {
+			Data []struct {
+				ID         string `json:"id"`
+				PostsCount int    `json:"posts_count"`
+			} `json:"data"`
+		}
+		c.do("GET", "/api/v2/categories", nil).decode(t, &cats)
+		got := [4]int{profile.Data.PostsCount, profile.Data.CommentsCount, profile.Data.LikesReceived}
+		for _, cat := range cats.Data {
+			if cat.ID == category {
+				got[3] = cat.PostsCount
+			}
+		}
+		return got
+	}
+
+	if got := counts(viewer); got != [4]int{1, 1, 1, 1} {
+		t.Fatalf("before muting: got %v, want [1 1 1 1]", got)
+	}
+	if res := viewer.do("PUT", "/api/v2/users/author/mute", nil); res.status != http.StatusNoContent {
+		t.Fatalf("cannot mute: %d %s", res.status, res.body)
+	}
+	if got := counts(viewer); got != [4]int{0, 0, 0, 0} {
+		t.Errorf("after muting the author: got %v, want [0 0 0 0]", got)
+	}
+	if got := counts(srv.anonymous()); got != [4]int{1, 1, 1, 1} {
+		t.Errorf("anonymously: got %v, want [1 1 1 1]", got)
+	}
+}